@@ -0,0 +1,533 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Action is a set of permission bits granted by an ACL entry.
+type Action uint8
+
+const (
+	ActionRead Action = 1 << iota
+	ActionWrite
+	ActionDelete
+	ActionAdmin
+)
+
+var actionLetters = []struct {
+	action Action
+	letter byte
+	name   string
+}{
+	{ActionRead, 'r', "read"},
+	{ActionWrite, 'w', "write"},
+	{ActionDelete, 'd', "delete"},
+	{ActionAdmin, 'a', "admin"},
+}
+
+// ParseActions parses a permission string such as "rw" or "rwda".
+func ParseActions(s string) (Action, error) {
+	var actions Action
+	for i := 0; i < len(s); i++ {
+		found := false
+		for _, al := range actionLetters {
+			if s[i] == al.letter {
+				actions |= al.action
+				found = true
+				break
+			}
+		}
+		if !found && s[i] != '-' {
+			return 0, fmt.Errorf("invalid permission %q", s)
+		}
+	}
+	if actions == 0 {
+		return 0, fmt.Errorf("empty permission %q", s)
+	}
+	return actions, nil
+}
+
+func (a Action) String() string {
+	var sb strings.Builder
+	for _, al := range actionLetters {
+		if a&al.action != 0 {
+			sb.WriteByte(al.letter)
+		}
+	}
+	return sb.String()
+}
+
+// Name returns the name of a single action, e.g. "read".
+func (a Action) Name() string {
+	for _, al := range actionLetters {
+		if a == al.action {
+			return al.name
+		}
+	}
+	return a.String()
+}
+
+func (a Action) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+func (a *Action) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseActions(s)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// ACL subjects. Named subjects are written as "user:<name>" or
+// "group:<name>".
+const (
+	SubjectAnyone        = "anyone"
+	SubjectAuthenticated = "authenticated"
+	subjectUserPrefix    = "user:"
+	subjectGroupPrefix   = "group:"
+)
+
+func validSubject(subject string) bool {
+	switch {
+	case subject == SubjectAnyone, subject == SubjectAuthenticated:
+		return true
+	case strings.HasPrefix(subject, subjectUserPrefix):
+		return len(subject) > len(subjectUserPrefix)
+	case strings.HasPrefix(subject, subjectGroupPrefix):
+		return len(subject) > len(subjectGroupPrefix)
+	}
+	return false
+}
+
+// subjectMatches reports whether subject covers user; a nil user is an
+// anonymous caller.
+func subjectMatches(subject string, user *User) bool {
+	switch {
+	case subject == SubjectAnyone:
+		return true
+	case user == nil:
+		return false
+	case subject == SubjectAuthenticated:
+		return true
+	case strings.HasPrefix(subject, subjectUserPrefix):
+		return user.Username == strings.TrimPrefix(subject, subjectUserPrefix)
+	case strings.HasPrefix(subject, subjectGroupPrefix):
+		group := strings.TrimPrefix(subject, subjectGroupPrefix)
+		for _, g := range user.Groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ACLEntry grants Actions on everything matched by Path to Subject.
+//
+// Path is a rule pattern as written in .permissions:
+//
+//	/ai_tools        anchored: ai_tools at the data root and everything below
+//	ai_tools         unanchored: any run of path segments, at any depth
+//	**/*.secret.md   gitignore-style glob; without a slash it matches names
+//	                 at any depth, and a matched directory covers its contents
+//	re:^notes/.+\.md$ regular expression over the whole relative path
+//
+// Lines holding only a pattern predate ACLs and are Legacy entries granting
+// authenticated users read access. A leading "!" makes the rule a negation:
+// paths it matches are exempt from the read, write and delete rules it
+// outranks. Negations never carry a subject.
+type ACLEntry struct {
+	Path    string `json:"path"`
+	Subject string `json:"subject"`
+	Actions Action `json:"actions"`
+	Negate  bool   `json:"negate,omitempty"`
+	Legacy  bool   `json:"legacy,omitempty"`
+
+	matcher pathMatcher
+}
+
+// pathMatcher reports whether a rule covers the path given as segments,
+// and the depth of the directory it was matched at.
+type pathMatcher func(parts []string) (int, bool)
+
+const regexRulePrefix = "re:"
+
+// negatableActions are the actions a negated rule exempts.
+const negatableActions = ActionRead | ActionWrite | ActionDelete
+
+// newACLEntry builds an entry from a pattern and optional subject and
+// actions. An empty subject makes a legacy entry.
+func newACLEntry(pattern, subject string, actions Action) (ACLEntry, error) {
+	pattern = strings.TrimSpace(pattern)
+	entry := ACLEntry{Subject: subject, Actions: actions}
+	if strings.HasPrefix(pattern, "!") {
+		entry.Negate = true
+		pattern = strings.TrimSpace(pattern[1:])
+	}
+	if pattern == "" {
+		return ACLEntry{}, fmt.Errorf("empty path pattern")
+	}
+	entry.Path = pattern
+
+	switch {
+	case entry.Negate:
+		if subject != "" {
+			return ACLEntry{}, fmt.Errorf("negated rule %q cannot name a subject", pattern)
+		}
+		entry.Actions = negatableActions
+	case subject == "":
+		entry.Subject = SubjectAuthenticated
+		entry.Actions = ActionRead
+		entry.Legacy = true
+	case !validSubject(subject):
+		return ACLEntry{}, fmt.Errorf("invalid subject %q", subject)
+	case actions == 0:
+		return ACLEntry{}, fmt.Errorf("no actions granted")
+	}
+
+	matcher, err := compilePattern(pattern)
+	if err != nil {
+		return ACLEntry{}, err
+	}
+	entry.matcher = matcher
+	return entry, nil
+}
+
+func (e ACLEntry) samePathAndSubject(other ACLEntry) bool {
+	return e.Path == other.Path && e.Negate == other.Negate && e.Legacy == other.Legacy &&
+		(e.Legacy || e.Negate || e.Subject == other.Subject)
+}
+
+// scope is the directory a rule is confined to: the literal leading
+// segments of an anchored pattern, or the data root for rules that can match
+// anywhere. Administering a rule requires admin rights on its scope.
+func (e ACLEntry) scope() string {
+	if !strings.HasPrefix(e.Path, "/") {
+		return ""
+	}
+	var literal []string
+	for _, part := range splitSegments(strings.Trim(e.Path, "/")) {
+		if strings.ContainsAny(part, "*?[") {
+			break
+		}
+		literal = append(literal, part)
+	}
+	return normalizeACLPath(strings.Join(literal, "/"))
+}
+
+// renamed returns an anchored copy of the entry for a move of oldRel to
+// newRel, if the entry names oldRel or a path below it literally. An
+// unanchored rule names them wherever its segments appear in a row: inside
+// oldRel, covering it, or starting with a trailing run of oldRel's
+// segments, covering a path below it. Glob and regex rules are never
+// rewritten.
+func (e ACLEntry) renamed(oldRel, newRel string) (ACLEntry, bool) {
+	if !e.literal() {
+		return ACLEntry{}, false
+	}
+	literal := normalizeACLPath(e.Path)
+	switch {
+	case literal == oldRel:
+		literal = newRel
+	case strings.HasPrefix(literal, oldRel+"/"):
+		literal = newRel + strings.TrimPrefix(literal, oldRel)
+	case e.anchored():
+		return ACLEntry{}, false
+	default:
+		rule, old := splitSegments(literal), splitSegments(oldRel)
+		if _, ok := unanchoredMatcher(rule)(old); ok {
+			literal = newRel
+			break
+		}
+		below := ""
+		for n := min(len(old), len(rule)-1); n > 0 && below == ""; n-- {
+			if strings.Join(old[len(old)-n:], "/") == strings.Join(rule[:n], "/") {
+				below = strings.Join(rule[n:], "/")
+			}
+		}
+		if below == "" {
+			return ACLEntry{}, false
+		}
+		literal = newRel + "/" + below
+	}
+
+	pattern, subject := "/"+literal, e.Subject
+	if e.Negate {
+		pattern, subject = "!"+pattern, ""
+	} else if e.Legacy {
+		subject = ""
+	}
+	entry, err := newACLEntry(pattern, subject, e.Actions)
+	if err != nil {
+		return ACLEntry{}, false
+	}
+	return entry, true
+}
+
+// literal reports whether the rule names paths literally rather than with
+// a glob or regex.
+func (e ACLEntry) literal() bool {
+	return !strings.HasPrefix(e.Path, regexRulePrefix) && !strings.ContainsAny(e.Path, "*?[")
+}
+
+func (e ACLEntry) anchored() bool {
+	return strings.HasPrefix(e.Path, "/")
+}
+
+func compilePattern(pattern string) (pathMatcher, error) {
+	if strings.HasPrefix(pattern, regexRulePrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, regexRulePrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex rule %q: %w", pattern, err)
+		}
+		return func(parts []string) (int, bool) {
+			return len(parts), re.MatchString(strings.Join(parts, "/"))
+		}, nil
+	}
+
+	anchored := strings.HasPrefix(pattern, "/")
+	body := strings.Trim(pattern, "/")
+	if !strings.ContainsAny(body, "*?[") {
+		prefix := splitSegments(normalizeACLPath(body))
+		if anchored {
+			return anchoredMatcher(prefix), nil
+		}
+		return unanchoredMatcher(prefix), nil
+	}
+
+	// gitignore: a pattern with a slash in the middle is relative to the
+	// root, otherwise it may match at any depth.
+	if !anchored && !strings.Contains(body, "/") {
+		body = "**/" + body
+	}
+	globParts := strings.Split(body, "/")
+	for _, part := range globParts {
+		if _, err := path.Match(part, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob rule %q: %w", pattern, err)
+		}
+	}
+	return globMatcher(globParts), nil
+}
+
+func anchoredMatcher(prefix []string) pathMatcher {
+	return func(parts []string) (int, bool) {
+		if len(prefix) > len(parts) {
+			return 0, false
+		}
+		for i := range prefix {
+			if prefix[i] != parts[i] {
+				return 0, false
+			}
+		}
+		return len(prefix), true
+	}
+}
+
+// unanchoredMatcher keeps the original .permissions behaviour: the rule
+// applies wherever its segments appear in a row.
+func unanchoredMatcher(prefix []string) pathMatcher {
+	return func(parts []string) (int, bool) {
+		if len(prefix) == 0 {
+			return 0, false
+		}
+		depth, found := 0, false
+		for i := 0; i+len(prefix) <= len(parts); i++ {
+			ok := true
+			for k := range prefix {
+				if parts[i+k] != prefix[k] {
+					ok = false
+					break
+				}
+			}
+			if ok {
+				depth, found = i+len(prefix), true
+			}
+		}
+		return depth, found
+	}
+}
+
+// globMatcher matches the path itself or any of its ancestors, so a glob
+// naming a directory covers everything inside it.
+func globMatcher(glob []string) pathMatcher {
+	return func(parts []string) (int, bool) {
+		for depth := len(parts); depth > 0; depth-- {
+			if matchGlobSegments(glob, parts[:depth]) {
+				return depth, true
+			}
+		}
+		return 0, false
+	}
+}
+
+func matchGlobSegments(glob, parts []string) bool {
+	if len(glob) == 0 {
+		return len(parts) == 0
+	}
+	if glob[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if matchGlobSegments(glob[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(glob[0], parts[0]); !ok {
+		return false
+	}
+	return matchGlobSegments(glob[1:], parts[1:])
+}
+
+func normalizeACLPath(p string) string {
+	clean := path.Clean("/" + strings.TrimSpace(p))
+	return strings.TrimPrefix(clean, "/")
+}
+
+func splitSegments(p string) []string {
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func (e ACLEntry) match(relPath string) (int, bool) {
+	if e.matcher == nil {
+		return 0, false
+	}
+	return e.matcher(splitSegments(normalizeACLPath(relPath)))
+}
+
+// parseACLLine parses one non-comment line of .permissions. An ACL line is
+// "<pattern> <subject> <actions>"; anything else is a bare pattern.
+func parseACLLine(line string) (ACLEntry, error) {
+	line = strings.TrimSpace(line)
+	fields := strings.Fields(line)
+	if len(fields) >= 3 {
+		n := len(fields)
+		subject, bits := fields[n-2], fields[n-1]
+		if validSubject(subject) {
+			actions, err := ParseActions(bits)
+			if err != nil {
+				return ACLEntry{}, err
+			}
+			rest := strings.TrimSpace(strings.TrimSuffix(line, bits))
+			rest = strings.TrimSuffix(rest, subject)
+			return newACLEntry(rest, subject, actions)
+		}
+	}
+	return newACLEntry(line, "", 0)
+}
+
+// String formats the entry the way parseACLLine reads it.
+func (e ACLEntry) String() string {
+	pattern := e.Path
+	if e.Negate {
+		pattern = "!" + pattern
+	}
+	if e.Legacy || e.Negate {
+		return pattern
+	}
+	return fmt.Sprintf("%s %s %s", pattern, e.Subject, e.Actions)
+}
+
+// roleCeiling is the most a user can ever do regardless of ACLs:
+// anonymous callers and viewers only read, editors may also write and
+// delete, and may administer paths they were explicitly granted.
+func roleCeiling(user *User) Action {
+	if user == nil {
+		return ActionRead
+	}
+	switch {
+	case user.Role.Allows(RoleEditor):
+		return ActionRead | ActionWrite | ActionDelete | ActionAdmin
+	case user.Role.Allows(RoleViewer):
+		return ActionRead
+	}
+	return 0
+}
+
+// aclDecision is the outcome of evaluating one action, with the rule that
+// decided it (nil when no rule applied).
+type aclDecision struct {
+	Allowed bool      `json:"allowed"`
+	Rule    *ACLEntry `json:"rule,omitempty"`
+	Reason  string    `json:"reason"`
+}
+
+// checkACL evaluates entries for one action. Entries covering that action
+// take part and the deepest match wins. At that depth a negation exempts
+// the path; otherwise the action is allowed if any entry's subject covers
+// user. Read, write and delete entries that do not cover the action still
+// close the path to everyone they do not name when they match deeper than
+// any entry that does, so "/private user:alice r" keeps bob from writing
+// there too. When no entry applies, everything but admin is allowed.
+func checkACL(entries []ACLEntry, user *User, relPath string, action Action) aclDecision {
+	best, closedAt := -1, -1
+	var negation, grant, deny, closer *ACLEntry
+	named := false
+	for i := range entries {
+		e := &entries[i]
+		if e.Actions&action == 0 {
+			if e.Negate || e.Actions&negatableActions == 0 || action == ActionAdmin {
+				continue
+			}
+			depth, ok := e.match(relPath)
+			if !ok || depth < closedAt {
+				continue
+			}
+			if depth > closedAt {
+				closedAt, closer, named = depth, e, false
+			}
+			if subjectMatches(e.Subject, user) {
+				named = true
+			}
+			continue
+		}
+		depth, ok := e.match(relPath)
+		if !ok || depth < best {
+			continue
+		}
+		if depth > best {
+			best, negation, grant, deny = depth, nil, nil, nil
+		}
+		switch {
+		case e.Negate:
+			if negation == nil {
+				negation = e
+			}
+		case subjectMatches(e.Subject, user):
+			if grant == nil {
+				grant = e
+			}
+		default:
+			if deny == nil {
+				deny = e
+			}
+		}
+	}
+
+	switch {
+	case closedAt > best && !named:
+		return aclDecision{Allowed: false, Rule: closer, Reason: "path closed by rule"}
+	case negation != nil:
+		return aclDecision{Allowed: action != ActionAdmin, Rule: negation, Reason: "negated rule"}
+	case grant != nil:
+		return aclDecision{Allowed: true, Rule: grant, Reason: "rule"}
+	case deny != nil:
+		return aclDecision{Allowed: false, Rule: deny, Reason: "rule"}
+	}
+	return aclDecision{Allowed: action != ActionAdmin, Reason: "default"}
+}
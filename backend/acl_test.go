@@ -0,0 +1,91 @@
+package main
+
+import "testing"
+
+func mustEntries(t *testing.T, lines ...string) []ACLEntry {
+	t.Helper()
+	entries := make([]ACLEntry, 0, len(lines))
+	for _, line := range lines {
+		entry, err := parseACLLine(line)
+		if err != nil {
+			t.Fatalf("parseACLLine(%q): %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestCheckACL(t *testing.T) {
+	alice := &User{Username: "alice", Role: RoleEditor}
+	bob := &User{Username: "bob", Role: RoleEditor}
+	ops := &User{Username: "carol", Role: RoleEditor, Groups: []string{"ops"}}
+
+	tests := []struct {
+		name   string
+		rules  []string
+		user   *User
+		path   string
+		action Action
+		want   bool
+	}{
+		{"no rules", nil, bob, "a.txt", ActionWrite, true},
+		{"no rules admin", nil, bob, "a.txt", ActionAdmin, false},
+		{"read rule grants named user", []string{"/private user:alice r"}, alice, "private/a.txt", ActionRead, true},
+		{"read rule denies others", []string{"/private user:alice r"}, bob, "private/a.txt", ActionRead, false},
+		{"read rule closes write to others", []string{"/private user:alice r"}, bob, "private/a.txt", ActionWrite, false},
+		{"read rule closes delete to others", []string{"/private user:alice r"}, bob, "private/a.txt", ActionDelete, false},
+		{"named user keeps default write", []string{"/private user:alice r"}, alice, "private/a.txt", ActionWrite, true},
+		{"closed path leaves siblings open", []string{"/private user:alice r"}, bob, "public/a.txt", ActionWrite, true},
+		{"deeper read rule closes write granted above",
+			[]string{"/data authenticated rwd", "/data/private user:alice r"}, bob, "data/private/a.txt", ActionWrite, false},
+		{"deeper write rule wins over closing rule",
+			[]string{"/team user:alice r", "/team/ops group:ops rwd"}, ops, "team/ops/a.txt", ActionWrite, true},
+		{"legacy rule keeps writes for logged-in users", []string{"pic"}, bob, "notes/pic/a.png", ActionWrite, true},
+		{"legacy rule hides from anonymous", []string{"pic"}, nil, "notes/pic/a.png", ActionRead, false},
+		{"negation reopens", []string{"/private user:alice r", "!/private/shared"}, bob, "private/shared/a.txt", ActionWrite, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkACL(mustEntries(t, tt.rules...), tt.user, tt.path, tt.action)
+			if got.Allowed != tt.want {
+				t.Errorf("checkACL(%s) = %v (%s), want %v", tt.action.Name(), got.Allowed, got.Reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenamedSkipsPatterns(t *testing.T) {
+	tests := []struct {
+		rule   string
+		oldRel string
+		newRel string
+		want   string
+	}{
+		{"/notes/pic user:alice r", "notes/pic", "notes/photos", "/notes/photos user:alice r"},
+		{"/notes/pic/secret user:alice r", "notes/pic", "archive/pic", "/archive/pic/secret user:alice r"},
+		{"!/notes/pic", "notes/pic", "notes/photos", "!/notes/photos"},
+		{"pic", "notes/pic", "notes/photos", "/notes/photos"},
+		{"/notes/other user:alice r", "notes/pic", "notes/photos", ""},
+		{"/notes/*.md user:alice r", "notes/a.md", "notes/b.md", ""},
+		{"**/pic user:alice r", "notes/pic", "notes/photos", ""},
+		{"/notes/pi? user:alice r", "notes/pic", "notes/photos", ""},
+		{"/notes/[p]ic user:alice r", "notes/pic", "notes/photos", ""},
+		{`re:^notes/pic(/|$) user:alice r`, "notes/pic", "notes/photos", ""},
+		{"!re:^notes/pic$", "notes/pic", "notes/photos", ""},
+	}
+	for _, tt := range tests {
+		entry := mustEntries(t, tt.rule)[0]
+		got, ok := entry.renamed(tt.oldRel, tt.newRel)
+		switch {
+		case tt.want == "" && ok:
+			t.Errorf("renamed(%q) of %q = %s, want no rewrite", tt.oldRel, tt.rule, got)
+		case tt.want != "" && !ok:
+			t.Errorf("renamed(%q) of %q: no rewrite, want %s", tt.oldRel, tt.rule, tt.want)
+		case ok && got.String() != tt.want:
+			t.Errorf("renamed(%q) of %q = %s, want %s", tt.oldRel, tt.rule, got, tt.want)
+		}
+		if !entry.literal() && ok {
+			t.Errorf("%q is a pattern but was rewritten", tt.rule)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces filePath with data without ever exposing a
+// partially written file: the data goes to a temporary file in the same
+// directory, is synced, and is then renamed over the target. On failure the
+// original file is left untouched. An existing file keeps its permission
+// bits; perm applies to new files. If filePath is a symlink, the file it
+// points to is replaced and the link is kept.
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	return writeAtomic(filePath, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeAtomic is writeFileAtomic for content produced by write, such as an
+// upload stream or a JSON encoder. If write fails the target is untouched.
+func writeAtomic(filePath string, perm os.FileMode, write func(w io.Writer) error) error {
+	return writeAtomicCommit(filePath, perm, write, nil)
+}
+
+// maxLinkHops bounds how many symlinks finalPath follows, as the kernel
+// does for path lookups.
+const maxLinkHops = 40
+
+// finalPath follows filePath for as long as it is a symlink, so that a
+// write through a link replaces the file it points to instead of the link.
+// A dangling link yields the path it points to.
+func finalPath(filePath string) (string, error) {
+	for hops := 0; ; hops++ {
+		info, err := os.Lstat(filePath)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return filePath, nil
+		}
+		if hops == maxLinkHops {
+			return "", errSymlinkBroken
+		}
+		link, err := os.Readlink(filePath)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(filePath), link)
+		}
+		filePath = link
+	}
+}
+
+// writeAtomicCommit is writeAtomic with a hook run once the new content is
+// safely on disk, just before it is renamed into place; it is where an
+// overwritten file is moved to the trash. If write or commit fails the
+// target is untouched and the new content is discarded. commit is not
+// undone if the rename after it fails, so a file it moved to the trash
+// stays there; that rename stays within one directory and only fails when
+// the directory itself has become unusable.
+func writeAtomicCommit(filePath string, perm os.FileMode, write func(w io.Writer) error, commit func() error) error {
+	filePath, err := finalPath(filePath)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(filePath); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if commit != nil {
+		if err := commit(); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
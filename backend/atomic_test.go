@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomicThroughSymlink(t *testing.T) {
+	tests := []struct {
+		name   string
+		link   string // target of pub/n.md
+		target string // file the write must land in
+	}{
+		{"relative link", "../real/n.md", "real/n.md"},
+		{"chained links", "../real/m.md", "real/n.md"},
+		{"dangling link", "../real/new.md", "real/new.md"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestFile(t, dir, "real/n.md", "orig")
+			mustSymlink(t, "n.md", filepath.Join(dir, "real", "m.md"))
+			writeTestFile(t, dir, "pub/.keep", "")
+			link := filepath.Join(dir, "pub", "n.md")
+			mustSymlink(t, tt.link, link)
+
+			if err := writeFileAtomic(link, []byte("edited"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+				t.Errorf("pub/n.md is no longer a symlink: %v", err)
+			}
+			data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(tt.target)))
+			if err != nil || string(data) != "edited" {
+				t.Errorf("%s = %q, %v; want %q", tt.target, data, err, "edited")
+			}
+		})
+	}
+}
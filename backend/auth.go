@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+)
+
+// Role controls which API operations a user may perform. Roles are ordered:
+// each one includes everything the roles below it can do.
+type Role string
+
+const (
+	RoleViewer Role = "viewer"
+	RoleEditor Role = "editor"
+	RoleAdmin  Role = "admin"
+)
+
+func (r Role) rank() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleEditor:
+		return 2
+	case RoleAdmin:
+		return 3
+	default:
+		return 0
+	}
+}
+
+func (r Role) Valid() bool {
+	return r.rank() > 0
+}
+
+// Allows reports whether a user holding r may perform an action that
+// requires required.
+func (r Role) Allows(required Role) bool {
+	return r.Valid() && r.rank() >= required.rank()
+}
+
+// access is what one HTTP method of an endpoint requires: a minimum role
+// (empty for anonymous access) and the ACL actions checked against the
+// request's "path" query parameter (zero to skip the path check).
+type access struct {
+	Role   Role
+	Action Action
+}
+
+// methodAccess maps HTTP methods to their access requirements. Methods
+// that are not listed are passed through unchecked, so the handler can
+// answer them with 405.
+type methodAccess map[string]access
+
+type userContextKey struct{}
+
+// authorize is the authorization layer every API handler goes through. It
+// attaches the caller to the request context, enforces the role for the
+// request method and, when an action is given, checks the ACL for the
+// "path" query parameter. Handlers whose target path only becomes known
+// later (request bodies, upload file names) finish the job with allowPath.
+func authorize(baseDir string, rules methodAccess, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(r)
+		if ok {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, user))
+		}
+		rule, restricted := rules[r.Method]
+		if !restricted {
+			next(w, r)
+			return
+		}
+		if rule.Role != "" {
+			if !ok {
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			if !user.Role.Allows(rule.Role) {
+				writeError(w, http.StatusForbidden, "insufficient role")
+				return
+			}
+		}
+		if rule.Action != 0 {
+			target, err := resolvePath(baseDir, r.URL.Query().Get("path"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if !allowPath(w, r, toRelative(baseDir, target), rule.Action) {
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// allowPath checks action on relPath for the caller attached by authorize
+// and writes a 403 response when it is denied.
+func allowPath(w http.ResponseWriter, r *http.Request, relPath string, action Action) bool {
+	if GetPermissionManager().Check(requestUser(r), relPath, action) {
+		return true
+	}
+	writeError(w, http.StatusForbidden, "no permission")
+	return false
+}
+
+// allowSubtree is allowPath for relPath and everything below it, given in
+// paths relative to relPath as subtreePaths lists them. Recursive
+// operations must pass it, or a rule on a nested path could be bypassed
+// by acting on one of its ancestors.
+func allowSubtree(w http.ResponseWriter, r *http.Request, relPath string, paths []string, action Action) bool {
+	for _, p := range paths {
+		if !allowPath(w, r, path.Join(relPath, p), action) {
+			return false
+		}
+	}
+	return true
+}
+
+// userFromContext returns the user attached by authorize.
+func userFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userContextKey{}).(User)
+	return user, ok
+}
+
+// requestUser returns the user attached by authorize, or nil for an
+// anonymous caller, in the form PermissionManager.Check expects.
+func requestUser(r *http.Request) *User {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		return nil
+	}
+	return &user
+}
+
+// currentUser resolves the X-Session-Token header to a user.
+func currentUser(r *http.Request) (User, bool) {
+	token := r.Header.Get("X-Session-Token")
+	if token == "" {
+		return User{}, false
+	}
+
+	um := GetUserManager()
+	if err := um.checkFileModified(); err != nil {
+		fmt.Printf("User file modified: %v\n", err)
+		GetSessionManager().ClearAllSessions()
+		return User{}, false
+	}
+
+	session, ok := GetSessionManager().ValidateAndTouch(token)
+	if !ok {
+		return User{}, false
+	}
+	user, exists := um.GetUser(session.Username)
+	if !exists {
+		return User{}, false
+	}
+	return user, true
+}
+
+func isAuthenticated(r *http.Request) bool {
+	_, ok := currentUser(r)
+	return ok
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// fileVersionMu makes an If-Match check and the write it guards one step,
+// so two saves based on the same version cannot both succeed.
+var fileVersionMu sync.Mutex
+
+// contentETag returns the strong ETag for a file's content.
+func contentETag(data []byte) string {
+	return `"` + contentHash(data) + `"`
+}
+
+// etagMatches reports whether an If-Match header value accepts etag. "*"
+// accepts any existing entry, including directories, which have no ETag.
+func etagMatches(header, etag string, exists bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" && exists {
+			return true
+		}
+		if etag != "" && candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch enforces the request's If-Match header against the current
+// state of filePath. When the file has changed it replies 412 with the
+// current ETag and content, so the client can show the conflict, and
+// returns false. Callers must hold fileVersionMu.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, filePath string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+
+	var etag string
+	var data []byte
+	info, err := os.Stat(filePath)
+	exists := err == nil
+	if exists && info.Mode().IsRegular() {
+		if data, err = os.ReadFile(filePath); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return false
+		}
+		etag = contentETag(data)
+	}
+	if etagMatches(header, etag, exists) {
+		return true
+	}
+
+	resp := map[string]string{"error": "file has changed"}
+	if !exists {
+		resp["error"] = "file no longer exists"
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+		resp["etag"] = etag
+		resp["content"] = string(data)
+	}
+	writeJSONStatus(w, http.StatusPreconditionFailed, resp)
+	return false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIfMatch(t *testing.T) {
+	tokens := newTestUsers(t, map[string]Role{"editor": RoleEditor})
+	dataDir := newTestDataDir(t)
+	writeTestFile(t, dataDir, "n.md", "v1")
+	server := newTestServer(t, dataDir)
+	send := func(method, target, body, ifMatch string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("X-Session-Token", tokens["editor"])
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w
+	}
+	content := func() string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dataDir, "n.md"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	expectConflict := func(w *httptest.ResponseRecorder, etag, current string) {
+		t.Helper()
+		if w.Code != http.StatusPreconditionFailed {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusPreconditionFailed, w.Body.String())
+		}
+		var resp map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if w.Header().Get("ETag") != etag || resp["etag"] != etag || resp["content"] != current {
+			t.Errorf("412 carries ETag %q, body %v; want %q and the current content %q", w.Header().Get("ETag"), resp, etag, current)
+		}
+	}
+
+	v1 := send(http.MethodGet, "/api/file?path=n.md", "", "").Header().Get("ETag")
+	if v1 != contentETag([]byte("v1")) {
+		t.Fatalf("GET ETag = %q", v1)
+	}
+	w := send(http.MethodPut, "/api/file?path=n.md", "v2", v1)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT with the current ETag = %d: %s", w.Code, w.Body.String())
+	}
+	v2 := w.Header().Get("ETag")
+	if v2 != contentETag([]byte("v2")) {
+		t.Errorf("PUT ETag = %q", v2)
+	}
+
+	// A save or delete based on v1 would lose v2.
+	expectConflict(send(http.MethodPut, "/api/file?path=n.md", "v1 edited", v1), v2, "v2")
+	expectConflict(send(http.MethodDelete, "/api/file?path=n.md", "", v1), v2, "v2")
+	if got := content(); got != "v2" {
+		t.Errorf("n.md = %q after refused requests, want v2", got)
+	}
+
+	// Any listed ETag, or "*" for an existing file, matches.
+	if w := send(http.MethodPut, "/api/file?path=n.md", "v3", v1+", "+v2); w.Code != http.StatusOK {
+		t.Errorf("PUT with a list of ETags = %d: %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodDelete, "/api/file?path=n.md", "", "*"); w.Code != http.StatusOK {
+		t.Errorf("DELETE with If-Match * = %d: %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodPut, "/api/file?path=n.md", "v4", "*"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with If-Match * on a deleted file = %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+	if w := send(http.MethodPut, "/api/file?path=n.md", "v4", ""); w.Code != http.StatusOK {
+		t.Errorf("PUT without If-Match = %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Conflict policies for operations that may hit an existing target.
+const (
+	conflictFail      = "fail"
+	conflictOverwrite = "overwrite"
+	conflictRename    = "rename"
+)
+
+var errTargetExists = errors.New("target already exists")
+
+func validConflictPolicy(policy string) bool {
+	switch policy {
+	case conflictFail, conflictOverwrite, conflictRename:
+		return true
+	}
+	return false
+}
+
+// nextFreePath returns target if nothing exists there yet, otherwise the
+// first free "name (n).ext" alongside it.
+func nextFreePath(target string) (string, error) {
+	if _, err := os.Lstat(target); os.IsNotExist(err) {
+		return target, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	dir, name := filepath.Split(target)
+	ext := filepath.Ext(name)
+	if info, err := os.Lstat(target); err == nil && info.IsDir() {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	for i := 1; i < 10000; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no free name for %s", name)
+}
+
+// resolveConflict applies policy to target. It returns the path to write
+// to and whether an existing entry there has to be replaced.
+func resolveConflict(target, policy string) (string, bool, error) {
+	if _, err := os.Lstat(target); os.IsNotExist(err) {
+		return target, false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	switch policy {
+	case conflictOverwrite:
+		return target, true, nil
+	case conflictRename:
+		free, err := nextFreePath(target)
+		return free, false, err
+	default:
+		return "", false, errTargetExists
+	}
+}
+
+// subtreePaths lists root and everything below it, slash-separated and
+// relative to root, which itself is listed as "". Symlinks are listed but
+// not followed.
+func subtreePaths(root string) ([]string, error) {
+	var paths []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+		return nil
+	})
+	return paths, err
+}
+
+// isWithin reports whether path is dir itself or lies below it.
+func isWithin(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// copyProgress describes how far a copy has got.
+type copyProgress struct {
+	TotalFiles  int   `json:"total_files"`
+	CopiedFiles int   `json:"copied_files"`
+	TotalBytes  int64 `json:"total_bytes"`
+	CopiedBytes int64 `json:"copied_bytes"`
+}
+
+// copyEntry is one item of a planned copy, relative to the source root.
+type copyEntry struct {
+	rel  string
+	info os.FileInfo
+}
+
+// planCopy lists everything under source up front, so totals are known
+// before copying starts and a copy placed inside its own source cannot
+// recurse into itself.
+func planCopy(source string) ([]copyEntry, copyProgress, error) {
+	var entries []copyEntry
+	var progress copyProgress
+	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, copyEntry{rel: rel, info: info})
+		if info.Mode().IsRegular() {
+			progress.TotalFiles++
+			progress.TotalBytes += info.Size()
+		}
+		return nil
+	})
+	return entries, progress, err
+}
+
+// copiedLinkTarget returns what the copy at dst of the symlink src should
+// point to. A relative link that stays inside the copied tree, source, is
+// kept, so the copy points into the copy. Any other relative link is
+// rewritten for dst's directory, so it still leads where src does, which
+// assumes dst lies as deep as the copy's final location. Absolute links
+// are kept as they are.
+func copiedLinkTarget(source, src, dst string) (string, error) {
+	link, err := os.Readlink(src)
+	if err != nil || filepath.IsAbs(link) {
+		return link, err
+	}
+	resolved := filepath.Join(filepath.Dir(src), link)
+	if isWithin(resolved, source) {
+		return link, nil
+	}
+	return filepath.Rel(filepath.Dir(dst), resolved)
+}
+
+// copyTree copies the planned entries from source to target, preserving
+// permission bits and modification times. Symlinks are copied as links
+// that lead where the originals do; see copiedLinkTarget. report is called
+// as data is written. On failure the partial copy is removed.
+func copyTree(source, target string, entries []copyEntry, progress *copyProgress, report func()) (err error) {
+	defer func() {
+		if err != nil {
+			os.RemoveAll(target)
+		}
+	}()
+
+	buf := make([]byte, 256<<10)
+	for _, entry := range entries {
+		src := filepath.Join(source, entry.rel)
+		dst := filepath.Join(target, entry.rel)
+		mode := entry.info.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.Mkdir(dst, mode.Perm()); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			link, err := copiedLinkTarget(source, src, dst)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, dst); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err := copyFile(src, dst, mode.Perm(), buf, progress, report); err != nil {
+				return err
+			}
+			progress.CopiedFiles++
+			report()
+		}
+	}
+
+	// Set times last, deepest first, since filling a directory bumps its
+	// modification time.
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.info.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		mtime := entry.info.ModTime()
+		if err := os.Chtimes(filepath.Join(target, entry.rel), mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTreeAtomic runs copyTree into a temporary sibling of target, which
+// is as deep as target, and renames the copy into place only once it is
+// complete, calling commit just before. A failed copy leaves an existing
+// target untouched.
+func copyTreeAtomic(source, target string, entries []copyEntry, progress *copyProgress, report func(), commit func() error) error {
+	tmp, err := os.MkdirTemp(filepath.Dir(target), "."+filepath.Base(target)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// copyTree creates the copy's root itself.
+	if err := os.Remove(tmp); err != nil {
+		return err
+	}
+	if err := copyTree(source, tmp, entries, progress, report); err != nil {
+		return err
+	}
+	if err := commit(); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return nil
+}
+
+// moveReplacing renames source to target. It first moves source to a
+// temporary sibling of target, so that commit, which clears an existing
+// target, only runs once the data has arrived; if commit fails, source is
+// put back.
+func moveReplacing(source, target string, commit func() error) error {
+	tmp, err := os.MkdirTemp(filepath.Dir(target), "."+filepath.Base(target)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	staged := filepath.Join(tmp, filepath.Base(target))
+	if err := os.Rename(source, staged); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := commit(); err != nil {
+		if restoreErr := os.Rename(staged, source); restoreErr != nil {
+			return fmt.Errorf("%v; source left at %s: %v", err, staged, restoreErr)
+		}
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(staged, target); err != nil {
+		return fmt.Errorf("%v; source left at %s", err, staged)
+	}
+	return os.Remove(tmp)
+}
+
+func copyFile(src, dst string, perm os.FileMode, buf []byte, progress *copyProgress, report func()) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	for {
+		n, readErr := in.Read(buf)
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				out.Close()
+				return err
+			}
+			progress.CopiedBytes += int64(n)
+			report()
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			out.Close()
+			return readErr
+		}
+	}
+	return out.Close()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopyTreeAtomic(t *testing.T) {
+	tests := []struct {
+		name       string
+		vanish     string // source file removed after planning, failing the copy
+		wantErr    bool
+		wantCommit bool
+		wantFile   string
+		wantBody   string
+	}{
+		{name: "complete copy replaces the target", wantCommit: true, wantFile: "b.txt", wantBody: "b"},
+		{name: "failed copy keeps the target", vanish: "b.txt", wantErr: true, wantFile: "old.txt", wantBody: "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			source := filepath.Join(dir, "src")
+			target := filepath.Join(dir, "dst")
+			writeTestFile(t, dir, "src/a.txt", "a")
+			writeTestFile(t, dir, "src/b.txt", "b")
+			writeTestFile(t, dir, "dst/old.txt", "old")
+
+			entries, progress, err := planCopy(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.vanish != "" {
+				if err := os.Remove(filepath.Join(source, tt.vanish)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			committed := false
+			err = copyTreeAtomic(source, target, entries, &progress, func() {}, func() error {
+				committed = true
+				return os.RemoveAll(target)
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("copyTreeAtomic() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if committed != tt.wantCommit {
+				t.Errorf("commit called = %v, want %v", committed, tt.wantCommit)
+			}
+			data, err := os.ReadFile(filepath.Join(target, tt.wantFile))
+			if err != nil || string(data) != tt.wantBody {
+				t.Errorf("%s = %q, %v; want %q", tt.wantFile, data, err, tt.wantBody)
+			}
+			entriesLeft, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entriesLeft {
+				if strings.Contains(entry.Name(), ".tmp-") {
+					t.Errorf("temporary copy %s left behind", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestMoveReplacing(t *testing.T) {
+	tests := []struct {
+		name       string
+		commitErr  error
+		wantSource bool
+		wantBody   string
+	}{
+		{name: "commit clears the target", wantBody: "new"},
+		{name: "failed commit puts the source back", commitErr: errors.New("trash full"), wantSource: true, wantBody: "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestFile(t, dir, "src/a.txt", "new")
+			writeTestFile(t, dir, "dst/a.txt", "old")
+			source := filepath.Join(dir, "src")
+			target := filepath.Join(dir, "dst")
+
+			err := moveReplacing(source, target, func() error {
+				if _, err := os.Stat(source); !os.IsNotExist(err) {
+					t.Errorf("source still in place when committing: %v", err)
+				}
+				if tt.commitErr != nil {
+					return tt.commitErr
+				}
+				return os.RemoveAll(target)
+			})
+			if !errors.Is(err, tt.commitErr) {
+				t.Fatalf("moveReplacing() error = %v, want %v", err, tt.commitErr)
+			}
+			if _, err := os.Stat(source); (err == nil) != tt.wantSource {
+				t.Errorf("source exists = %v, want %v", err == nil, tt.wantSource)
+			}
+			data, err := os.ReadFile(filepath.Join(target, "a.txt"))
+			if err != nil || string(data) != tt.wantBody {
+				t.Errorf("target = %q, %v; want %q", data, err, tt.wantBody)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if strings.Contains(entry.Name(), ".tmp-") {
+					t.Errorf("temporary move %s left behind", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestCopiedLinkTarget(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string // the copied tree, holding the link "a"
+		link   string
+		dst    string // where the copy of "a" goes
+		want   string
+	}{
+		{"into the copied tree", "dir", "b.txt", "x/y/dir/a", "b.txt"},
+		{"into a copied subdirectory", "dir", "sub/c.txt", "x/y/dir/a", "sub/c.txt"},
+		{"out of the tree, copied deeper", "dir", "../shared/s.txt", "x/y/dir/a", "../../../shared/s.txt"},
+		{"out of the tree, copied higher", "top/dir", "../../shared/s.txt", "dir/a", "../shared/s.txt"},
+		{"absolute", "dir", "/etc/hosts", "x/dir/a", "/etc/hosts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := t.TempDir()
+			source := filepath.Join(dataDir, filepath.FromSlash(tt.source))
+			if err := os.MkdirAll(source, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			src := filepath.Join(source, "a")
+			mustSymlink(t, tt.link, src)
+			got, err := copiedLinkTarget(source, src, filepath.Join(dataDir, filepath.FromSlash(tt.dst)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != filepath.FromSlash(tt.want) {
+				t.Errorf("copiedLinkTarget = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
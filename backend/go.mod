@@ -1,3 +1,5 @@
 module filemanager
 
 go 1.22.0
+
+require golang.org/x/crypto v0.33.0
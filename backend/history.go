@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHistoryMaxRevisions = 50
+	historyGCInterval          = 24 * time.Hour
+)
+
+var errRevisionNotFound = errors.New("revision not found")
+
+// Revision is one saved version of a file. ID is the SHA-256 of the
+// content, which is stored once no matter how many revisions share it.
+type Revision struct {
+	ID     string    `json:"id"`
+	Size   int64     `json:"size"`
+	Time   time.Time `json:"time"`
+	Author string    `json:"author"`
+}
+
+type historyIndex struct {
+	Path      string     `json:"path"`
+	Revisions []Revision `json:"revisions"`
+}
+
+// HistoryManager keeps file revisions under <data>/.filemanager/history:
+// content blobs in objects/<aa>/<sha256> and one index per file, named
+// after the hash of its path, in index/. The newest revision always matches
+// the file on disk.
+type HistoryManager struct {
+	mu           sync.Mutex
+	objectsDir   string
+	indexDir     string
+	maxRevisions int
+	gc           *backgroundJob
+}
+
+var globalHistoryManager *HistoryManager
+
+// InitHistoryManager prepares the history directory. maxRevisions caps the
+// revisions kept per file; zero keeps all of them.
+func InitHistoryManager(dataDir string, maxRevisions int) error {
+	historyDir := filepath.Join(dataDir, systemDirName, "history")
+	hm := &HistoryManager{
+		objectsDir:   filepath.Join(historyDir, "objects"),
+		indexDir:     filepath.Join(historyDir, "index"),
+		maxRevisions: maxRevisions,
+	}
+	for _, dir := range []string{hm.objectsDir, hm.indexDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	globalHistoryManager = hm
+	hm.gc = startJob(historyGCInterval, true, hm.gcOnce)
+	return nil
+}
+
+// Close stops the garbage collection job.
+func (hm *HistoryManager) Close() {
+	hm.gc.Stop()
+}
+
+func GetHistoryManager() *HistoryManager {
+	return globalHistoryManager
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (hm *HistoryManager) indexPath(relPath string) string {
+	return filepath.Join(hm.indexDir, contentHash([]byte(relPath))+".json")
+}
+
+func (hm *HistoryManager) objectPath(id string) string {
+	return filepath.Join(hm.objectsDir, id[:2], id)
+}
+
+func validRevisionID(id string) bool {
+	if len(id) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// loadIndex must be called with hm.mu held.
+func (hm *HistoryManager) loadIndex(relPath string) (historyIndex, error) {
+	index := historyIndex{Path: relPath}
+	data, err := os.ReadFile(hm.indexPath(relPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return index, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, err
+	}
+	return index, nil
+}
+
+// saveIndex must be called with hm.mu held.
+func (hm *HistoryManager) saveIndex(index historyIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(hm.indexPath(index.Path), data, 0o644)
+}
+
+func (hm *HistoryManager) storeObject(data []byte) (string, error) {
+	id := contentHash(data)
+	objectPath := hm.objectPath(id)
+	if _, err := os.Stat(objectPath); err == nil {
+		return id, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0o755); err != nil {
+		return "", err
+	}
+	return id, writeFileAtomic(objectPath, data, 0o644)
+}
+
+// Record adds content as the newest revision of relPath. previous is the
+// file's content before the save; it is recorded first when the file has
+// no history yet, so the version that existed before history was kept is
+// not lost.
+func (hm *HistoryManager) Record(relPath string, previous []byte, previousTime time.Time, content []byte, author string) error {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	index, err := hm.loadIndex(relPath)
+	if err != nil {
+		return err
+	}
+	if len(index.Revisions) == 0 && previous != nil {
+		id, err := hm.storeObject(previous)
+		if err != nil {
+			return err
+		}
+		index.Revisions = append(index.Revisions, Revision{ID: id, Size: int64(len(previous)), Time: previousTime})
+	}
+	id, err := hm.storeObject(content)
+	if err != nil {
+		return err
+	}
+	if n := len(index.Revisions); n > 0 && index.Revisions[n-1].ID == id {
+		return nil
+	}
+	index.Revisions = append(index.Revisions, Revision{ID: id, Size: int64(len(content)), Time: time.Now(), Author: author})
+	if hm.maxRevisions > 0 && len(index.Revisions) > hm.maxRevisions {
+		index.Revisions = index.Revisions[len(index.Revisions)-hm.maxRevisions:]
+	}
+	return hm.saveIndex(index)
+}
+
+// List returns the revisions of relPath, newest first.
+func (hm *HistoryManager) List(relPath string) ([]Revision, error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	index, err := hm.loadIndex(relPath)
+	if err != nil {
+		return nil, err
+	}
+	revisions := make([]Revision, len(index.Revisions))
+	for i, revision := range index.Revisions {
+		revisions[len(revisions)-1-i] = revision
+	}
+	return revisions, nil
+}
+
+// Content returns the stored content of revision id of relPath.
+func (hm *HistoryManager) Content(relPath, id string) ([]byte, error) {
+	revisions, err := hm.List(relPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, revision := range revisions {
+		if revision.ID == id {
+			return os.ReadFile(hm.objectPath(id))
+		}
+	}
+	return nil, errRevisionNotFound
+}
+
+// SaveFile writes content to filePath and records it as a revision of
+// relPath by author. A failure to record history is logged rather than
+// returned, since the save itself went through.
+func (hm *HistoryManager) SaveFile(filePath, relPath string, content []byte, author string) error {
+	var previous []byte
+	var previousTime time.Time
+	if info, err := os.Stat(filePath); err == nil && info.Mode().IsRegular() {
+		if previous, err = os.ReadFile(filePath); err != nil {
+			return err
+		}
+		previousTime = info.ModTime()
+	}
+	if err := writeFileAtomic(filePath, content, 0o644); err != nil {
+		return err
+	}
+	if err := hm.Record(relPath, previous, previousTime, content, author); err != nil {
+		fmt.Printf("Failed to record history for %s: %v\n", relPath, err)
+	}
+	return nil
+}
+
+// collectGarbage removes content blobs that no index refers to any more,
+// after revisions were dropped by the per-file cap.
+func (hm *HistoryManager) collectGarbage() (int, error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	referenced := make(map[string]bool)
+	indexFiles, err := os.ReadDir(hm.indexDir)
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range indexFiles {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(hm.indexDir, file.Name()))
+		if err != nil {
+			return 0, err
+		}
+		var index historyIndex
+		if err := json.Unmarshal(data, &index); err != nil {
+			// Keep every blob rather than risk deleting one a damaged
+			// index still needs.
+			return 0, fmt.Errorf("%s: %w", file.Name(), err)
+		}
+		for _, revision := range index.Revisions {
+			referenced[revision.ID] = true
+		}
+	}
+
+	removed := 0
+	err = filepath.WalkDir(hm.objectsDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || referenced[d.Name()] {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+func (hm *HistoryManager) gcOnce() {
+	removed, err := hm.collectGarbage()
+	if err != nil {
+		fmt.Printf("History garbage collection failed: %v\n", err)
+	} else if removed > 0 {
+		fmt.Printf("Removed %d unreferenced history object(s)\n", removed)
+	}
+}
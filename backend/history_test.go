@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHistoryCapAndGarbageCollection(t *testing.T) {
+	tokens := newTestUsers(t, map[string]Role{"editor": RoleEditor})
+	dataDir := newTestDataDir(t)
+	// Collection runs by hand below, not behind the test's back.
+	hm := GetHistoryManager()
+	hm.Close()
+	hm.gc = nil
+	hm.maxRevisions = 3
+	writeTestFile(t, dataDir, "n.md", "v0")
+	server := newTestServer(t, dataDir)
+
+	for _, content := range []string{"v1", "v2", "v2", "v3", "v4"} {
+		if w := serve(server, http.MethodPut, "/api/file?path=n.md", strings.NewReader(content), tokens["editor"]); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s = %d: %s", content, w.Code, w.Body.String())
+		}
+	}
+
+	w := serve(server, http.MethodGet, "/api/history?path=n.md", nil, tokens["editor"])
+	var listed struct {
+		Revisions []Revision `json:"revisions"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, revision := range listed.Revisions {
+		if revision.Author != "editor" {
+			t.Errorf("revision %s has author %q", revision.ID, revision.Author)
+		}
+		got = append(got, revision.ID)
+	}
+	want := []string{contentHash([]byte("v4")), contentHash([]byte("v3")), contentHash([]byte("v2"))}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("revisions %v, want v4, v3, v2", got)
+	}
+
+	// Revisions dropped by the cap are gone from the API at once and
+	// their blobs go with the next collection.
+	dropped := contentHash([]byte("v0"))
+	if w := serve(server, http.MethodGet, "/api/history/revision?path=n.md&id="+dropped, nil, tokens["editor"]); w.Code != http.StatusNotFound {
+		t.Errorf("dropped revision = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	removed, err := hm.collectGarbage()
+	if err != nil || removed != 2 {
+		t.Errorf("collectGarbage = %d, %v; want 2 blobs (v0, v1)", removed, err)
+	}
+	for _, content := range []string{"v0", "v1"} {
+		if _, err := os.Stat(hm.objectPath(contentHash([]byte(content)))); !os.IsNotExist(err) {
+			t.Errorf("blob of %s survived: %v", content, err)
+		}
+	}
+	if removed, err := hm.collectGarbage(); err != nil || removed != 0 {
+		t.Errorf("second collectGarbage = %d, %v; want nothing", removed, err)
+	}
+
+	// Restoring a kept revision makes it the newest one.
+	restore := HistoryRestoreRequest{Path: "n.md", ID: want[2]}
+	if w := serve(server, http.MethodPost, "/api/history/restore", jsonBody(t, restore), tokens["editor"]); w.Code != http.StatusOK {
+		t.Fatalf("restore = %d: %s", w.Code, w.Body.String())
+	}
+	if data, err := os.ReadFile(filepath.Join(dataDir, "n.md")); err != nil || string(data) != "v2" {
+		t.Errorf("n.md = %q, %v after restoring v2", data, err)
+	}
+	if revisions, err := hm.List("n.md"); err != nil || len(revisions) != 3 || revisions[0].ID != want[2] {
+		t.Errorf("revisions after restore = %+v, %v", revisions, err)
+	}
+
+	// A damaged index stops collection rather than losing blobs.
+	if err := os.WriteFile(filepath.Join(hm.indexDir, "broken.json"), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hm.collectGarbage(); err == nil {
+		t.Error("collectGarbage ignored a damaged index")
+	}
+}
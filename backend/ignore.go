@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ignoreFileName is the per-directory file listing entries to keep out of
+// the tree and search results, in gitignore syntax.
+const ignoreFileName = ".fmignore"
+
+// defaultIgnorePatterns apply below every .fmignore unless replaced with
+// the FMIGNORE_DEFAULTS environment variable.
+var defaultIgnorePatterns = []string{
+	".git/",
+	".svn/",
+	".hg/",
+	"node_modules/",
+	".DS_Store",
+	"Thumbs.db",
+	"*.swp",
+	"*.swo",
+	"*~",
+	ignoreFileName,
+}
+
+// ignoreRule is one gitignore pattern. glob is relative to the directory
+// holding the rule; patterns without an inner slash start with "**".
+type ignoreRule struct {
+	glob    []string
+	negate  bool
+	dirOnly bool
+}
+
+// parseIgnoreRule parses one line of an ignore file. It returns false for
+// blank lines, comments and patterns that are not valid globs.
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	var rule ignoreRule
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		line = "**/" + line
+	}
+	rule.glob = strings.Split(line, "/")
+	for _, part := range rule.glob {
+		if _, err := path.Match(part, ""); err != nil {
+			return ignoreRule{}, false
+		}
+	}
+	return rule, true
+}
+
+func parseIgnoreRules(lines []string) []ignoreRule {
+	var rules []ignoreRule
+	for _, line := range lines {
+		if rule, ok := parseIgnoreRule(line); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// ignoreLevel is the rules of one .fmignore and the directory it lives in.
+type ignoreLevel struct {
+	base  []string
+	rules []ignoreRule
+}
+
+// ignoreMatcher decides which entries of one directory are ignored. Like
+// git, the last matching rule wins, and rules from deeper .fmignore files
+// come later than those of their parents.
+type ignoreMatcher []ignoreLevel
+
+func (m ignoreMatcher) ignored(relPath string, isDir bool) bool {
+	parts := splitSegments(relPath)
+	ignored := false
+	for _, level := range m {
+		if len(level.base) >= len(parts) {
+			continue
+		}
+		rel := parts[len(level.base):]
+		for _, rule := range level.rules {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if matchGlobSegments(rule.glob, rel) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
+
+type cachedIgnoreFile struct {
+	modTime time.Time
+	size    int64
+	rules   []ignoreRule
+}
+
+// IgnoreManager reads .fmignore files on demand and caches them until they
+// change on disk.
+type IgnoreManager struct {
+	mu       sync.Mutex
+	dataDir  string
+	defaults []ignoreRule
+	files    map[string]cachedIgnoreFile
+}
+
+var globalIgnoreManager *IgnoreManager
+
+func InitIgnoreManager(dataDir string, defaults []string) {
+	globalIgnoreManager = &IgnoreManager{
+		dataDir:  dataDir,
+		defaults: parseIgnoreRules(defaults),
+		files:    make(map[string]cachedIgnoreFile),
+	}
+}
+
+func GetIgnoreManager() *IgnoreManager {
+	return globalIgnoreManager
+}
+
+// rulesIn returns the rules of the .fmignore in the data-dir relative
+// directory dirRel, or nil if there is none.
+func (im *IgnoreManager) rulesIn(dirRel string) []ignoreRule {
+	filePath := filepath.Join(im.dataDir, filepath.FromSlash(dirRel), ignoreFileName)
+	info, err := os.Stat(filePath)
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if err != nil || !info.Mode().IsRegular() {
+		delete(im.files, dirRel)
+		return nil
+	}
+	if cached, ok := im.files[dirRel]; ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.rules
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil
+	}
+	rules := parseIgnoreRules(strings.Split(string(data), "\n"))
+	im.files[dirRel] = cachedIgnoreFile{modTime: info.ModTime(), size: info.Size(), rules: rules}
+	return rules
+}
+
+// ForDir returns the matcher for entries of the data-dir relative
+// directory dirRel: the server defaults followed by every .fmignore from
+// the data root down to dirRel.
+func (im *IgnoreManager) ForDir(dirRel string) ignoreMatcher {
+	matcher := ignoreMatcher{{rules: im.defaults}}
+	parts := splitSegments(dirRel)
+	for depth := 0; depth <= len(parts); depth++ {
+		base := parts[:depth]
+		if rules := im.rulesIn(strings.Join(base, "/")); rules != nil {
+			matcher = append(matcher, ignoreLevel{base: base, rules: rules})
+		}
+	}
+	return matcher
+}
+
+// PathIgnored reports whether the data-dir relative path relPath, or any
+// directory above it, is ignored.
+func (im *IgnoreManager) PathIgnored(relPath string, isDir bool) bool {
+	matcher := ignoreMatcher{{rules: im.defaults}}
+	parts := splitSegments(relPath)
+	for depth := range parts {
+		base := parts[:depth]
+		if rules := im.rulesIn(strings.Join(base, "/")); rules != nil {
+			matcher = append(matcher, ignoreLevel{base: base, rules: rules})
+		}
+		if matcher.ignored(strings.Join(parts[:depth+1], "/"), depth < len(parts)-1 || isDir) {
+			return true
+		}
+	}
+	return false
+}
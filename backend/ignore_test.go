@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestPathIgnored(t *testing.T) {
+	dataDir := newTestDataDir(t)
+	writeTestFile(t, dataDir, ".fmignore", "# comment\n*.log\n!keep.log\nbuild/\n/top.txt\ndocs/*.tmp\n")
+	writeTestFile(t, dataDir, "sub/.fmignore", "!*.log\n")
+	im := GetIgnoreManager()
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.log", false, true},
+		{"keep.log", false, false},
+		{"deep/x/a.log", false, true},
+		{"sub/a.log", false, false},
+		{"sub/x/a.log", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"x/build", true, true},
+		{"x/build/out.txt", false, true},
+		{"top.txt", false, true},
+		{"x/top.txt", false, false},
+		{"docs/a.tmp", false, true},
+		{"x/docs/a.tmp", false, false},
+		{".git/config", false, true},
+		{".fmignore", false, true},
+		{"notes.md", false, false},
+	}
+	for _, tt := range tests {
+		if got := im.PathIgnored(tt.path, tt.isDir); got != tt.ignored {
+			t.Errorf("PathIgnored(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.ignored)
+		}
+	}
+}
+
+func TestSearchHiddenEntries(t *testing.T) {
+	dataDir := newTestDataDir(t)
+	writeTestFile(t, dataDir, ".fmignore", "secret.md\n")
+	writeTestFile(t, dataDir, "open.md", "needle")
+	writeTestFile(t, dataDir, "secret.md", "needle")
+	writeTestFile(t, dataDir, "node_modules/pkg/readme.md", "needle")
+	GetSearchManager().Refresh("")
+	tokens := newTestUsers(t, map[string]Role{"viewer": RoleViewer})
+	server := newTestServer(t, dataDir)
+
+	search := func(target, token string) []string {
+		t.Helper()
+		w := serve(server, http.MethodGet, target, nil, token)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d, body %s", target, w.Code, w.Body.String())
+		}
+		var body struct {
+			Results []SearchResult `json:"results"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, result := range body.Results {
+			paths = append(paths, result.Path)
+		}
+		return paths
+	}
+
+	if got := search("/api/search?q=needle", tokens["admin"]); len(got) != 1 || got[0] != "open.md" {
+		t.Errorf("search without hidden = %v, want [open.md]", got)
+	}
+	if got := search("/api/search?q=needle&hidden=true", tokens["admin"]); len(got) != 3 {
+		t.Errorf("search with hidden = %v, want all three files", got)
+	}
+	if w := serve(server, http.MethodGet, "/api/search?q=needle&hidden=true", nil, tokens["viewer"]); w.Code != http.StatusForbidden {
+		t.Errorf("viewer search with hidden: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// A rule added after indexing hides the file at once.
+	writeTestFile(t, dataDir, ".fmignore", "secret.md\nopen.md\n")
+	if got := search("/api/search?q=needle", tokens["admin"]); len(got) != 0 {
+		t.Errorf("search after ignoring open.md = %v, want none", got)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "time"
+
+// backgroundJob is the periodic work a manager does on its own goroutine,
+// such as purging the trash or rescanning for search.
+type backgroundJob struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startJob calls run every interval, and once right away when immediate
+// is set, until the job is stopped.
+func startJob(interval time.Duration, immediate bool, run func()) *backgroundJob {
+	job := &backgroundJob{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(job.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		if immediate {
+			run()
+		}
+		for {
+			select {
+			case <-ticker.C:
+				run()
+			case <-job.stop:
+				return
+			}
+		}
+	}()
+	return job
+}
+
+// Stop ends the job, waiting for a run in progress to finish. Stopping a
+// nil job, as kept by managers configured without one, does nothing.
+func (j *backgroundJob) Stop() {
+	if j == nil {
+		return
+	}
+	close(j.stop)
+	<-j.done
+}
@@ -10,16 +10,52 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Node struct {
-	Name     string `json:"name"`
-	Path     string `json:"path"`
-	Type     string `json:"type"`
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Type      string `json:"type"`
+	Locked    bool   `json:"locked,omitempty"`
+	Protected bool   `json:"protected,omitempty"`
+	Symlink   bool   `json:"symlink,omitempty"`
+	*NodeMeta
 	Children []Node `json:"children,omitempty"`
 }
 
+// How /api/tree presents entries the caller may not read, selected with
+// the TREE_PROTECTED environment variable.
+const (
+	protectedLock = "lock" // keep the entry as a locked node without children
+	protectedHide = "hide" // leave the entry out entirely
+)
+
+// TreeOptions controls what buildTree includes for a given caller and in
+// which order. Depth is the number of directory levels to expand; negative
+// means all. ShowHidden includes entries matched by .fmignore rules, and
+// ChildCounts adds the number of entries to every directory listed.
+type TreeOptions struct {
+	User          *User
+	ProtectedMode string
+	Depth         int
+	Sort          nodeSort
+	ShowHidden    bool
+	ChildCounts   bool
+
+	// ancestors are the directories buildTree is inside of, used to stop
+	// at symlinks leading back up the tree.
+	ancestors []os.FileInfo
+}
+
+// Paging limits for /api/list.
+const (
+	defaultListLimit = 200
+	maxListLimit     = 1000
+)
+
 type FileResponse struct {
 	Type    string `json:"type"`
 	Content string `json:"content"`
@@ -33,13 +69,56 @@ type CreateRequest struct {
 	Content string `json:"content"`
 }
 
+// MoveRequest renames or moves Source to Destination, both relative to the
+// data dir. Conflict is one of "fail" (default), "overwrite" or "rename".
+type MoveRequest struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Conflict    string `json:"conflict"`
+}
+
+// CopyRequest duplicates Source at Destination; an empty Destination
+// copies next to the source. Conflict defaults to "rename", which keeps both
+// as "name (1).ext". With Progress set the response is a stream of JSON
+// lines reporting progress, ending with the result.
+type CopyRequest struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Conflict    string `json:"conflict"`
+	Progress    bool   `json:"progress"`
+}
+
+const copyProgressInterval = 250 * time.Millisecond
+
+// RestoreRequest restores a trash item to its original path. Conflict is
+// one of "fail" (default), "overwrite" or "rename".
+type RestoreRequest struct {
+	ID       string `json:"id"`
+	Conflict string `json:"conflict"`
+}
+
+// HistoryRestoreRequest makes revision ID the current content of Path.
+type HistoryRestoreRequest struct {
+	Path string `json:"path"`
+	ID   string `json:"id"`
+}
+
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
+// PermissionRequest adds or removes an ACL entry. Path uses the same
+// pattern syntax as .permissions; without a subject it refers to a bare
+// protected pattern, readable by any logged-in user.
 type PermissionRequest struct {
-	Path string `json:"path"`
+	Path    string `json:"path"`
+	Subject string `json:"subject"`
+	Actions Action `json:"actions"`
+}
+
+func (req PermissionRequest) entry() (ACLEntry, error) {
+	return newACLEntry(req.Path, req.Subject, req.Actions)
 }
 
 func main() {
@@ -65,7 +144,7 @@ func main() {
 		panic(err)
 	}
 
-	if err := InitPermissionManager(absUserDir); err != nil {
+	if err := InitPermissionManager(absUserDir, absDataDir); err != nil {
 		panic(err)
 	}
 
@@ -73,10 +152,120 @@ func main() {
 		panic(err)
 	}
 
-	InitSessionManager()
+	trashRetention := defaultTrashRetention
+	if value := os.Getenv("TRASH_RETENTION"); value != "" {
+		trashRetention, err = time.ParseDuration(value)
+		if err != nil || trashRetention < 0 {
+			panic(fmt.Sprintf("invalid TRASH_RETENTION %q", value))
+		}
+	}
+	if err := InitTrashManager(absDataDir, trashRetention); err != nil {
+		panic(err)
+	}
+
+	historyMaxRevisions := defaultHistoryMaxRevisions
+	if value := os.Getenv("HISTORY_MAX_REVISIONS"); value != "" {
+		historyMaxRevisions, err = strconv.Atoi(value)
+		if err != nil || historyMaxRevisions < 0 {
+			panic(fmt.Sprintf("invalid HISTORY_MAX_REVISIONS %q", value))
+		}
+	}
+	if err := InitHistoryManager(absDataDir, historyMaxRevisions); err != nil {
+		panic(err)
+	}
+
+	uploadMaxSize := int64(defaultUploadMaxSize)
+	if value := os.Getenv("UPLOAD_MAX_SIZE"); value != "" {
+		uploadMaxSize, err = parseByteSize(value)
+		if err != nil {
+			panic(fmt.Sprintf("invalid UPLOAD_MAX_SIZE %q", value))
+		}
+	}
+
+	tusExpiry := defaultTusExpiry
+	if value := os.Getenv("TUS_EXPIRY"); value != "" {
+		tusExpiry, err = time.ParseDuration(value)
+		if err != nil || tusExpiry < 0 {
+			panic(fmt.Sprintf("invalid TUS_EXPIRY %q", value))
+		}
+	}
+	var tusMaxSize int64
+	if value := os.Getenv("TUS_MAX_SIZE"); value != "" {
+		tusMaxSize, err = parseByteSize(value)
+		if err != nil {
+			panic(fmt.Sprintf("invalid TUS_MAX_SIZE %q", value))
+		}
+	}
+	if err := InitTusManager(absDataDir, tusExpiry, tusMaxSize); err != nil {
+		panic(err)
+	}
+
+	ignoreDefaults := defaultIgnorePatterns
+	if value, ok := os.LookupEnv("FMIGNORE_DEFAULTS"); ok {
+		ignoreDefaults = strings.Split(value, ",")
+	}
+	InitIgnoreManager(absDataDir, ignoreDefaults)
+
+	if value := os.Getenv("SYMLINK_POLICY"); value != "" {
+		if !validSymlinkPolicy(value) {
+			panic(fmt.Sprintf("invalid SYMLINK_POLICY %q (expected %q, %q or %q)", value, symlinkDeny, symlinkWithinRoot, symlinkFollowAll))
+		}
+		symlinkPolicy = value
+	}
+	InitSearchManager(absDataDir)
+
+	protectedMode := os.Getenv("TREE_PROTECTED")
+	switch protectedMode {
+	case "":
+		protectedMode = protectedLock
+	case protectedLock, protectedHide:
+	default:
+		panic(fmt.Sprintf("invalid TREE_PROTECTED %q (expected %q or %q)", protectedMode, protectedLock, protectedHide))
+	}
+
+	sessionStore, err := OpenSessionStore(os.Getenv("SESSION_STORE"), absUserDir)
+	if err != nil {
+		panic(err)
+	}
+	InitSessionManager(sessionStore)
+
+	handler := newServer(serverConfig{
+		DataDir:        absDataDir,
+		StaticDir:      filepath.Join(".", "frontend", "dist"),
+		ProtectedMode:  protectedMode,
+		TrashRetention: trashRetention,
+		UploadMaxSize:  uploadMaxSize,
+	})
+
+	addr := ":8080"
+	fmt.Printf("File manager running on %s (data dir: %s)\n", addr, absDataDir)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		panic(err)
+	}
+}
+
+// serverConfig is what the HTTP handlers need to know beyond the global
+// managers, which must be initialised before newServer is called.
+type serverConfig struct {
+	DataDir        string
+	StaticDir      string
+	ProtectedMode  string
+	TrashRetention time.Duration
+	UploadMaxSize  int64
+}
+
+// newServer registers the API routes and the frontend and returns the
+// handler serving them.
+func newServer(cfg serverConfig) http.Handler {
+	absDataDir := cfg.DataDir
+	protectedMode := cfg.ProtectedMode
+	trashRetention := cfg.TrashRetention
+	uploadMaxSize := cfg.UploadMaxSize
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/tree", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/tree", authorize(absDataDir, methodAccess{
+		http.MethodGet: {Action: ActionRead},
+	}, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
@@ -87,15 +276,134 @@ func main() {
 			writeError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		node, err := buildTree(absDataDir, rootPath)
+		depth := -1
+		if value := r.URL.Query().Get("depth"); value != "" {
+			depth, err = strconv.Atoi(value)
+			if err != nil || depth < 0 {
+				writeError(w, http.StatusBadRequest, "invalid depth")
+				return
+			}
+		}
+		order, err := parseNodeSort(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		counts, err := parseChildCounts(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		showHidden, ok := showHiddenEntries(w, r)
+		if !ok {
+			return
+		}
+		node, err := buildTree(absDataDir, rootPath, TreeOptions{
+			User:          requestUser(r),
+			ProtectedMode: protectedMode,
+			Depth:         depth,
+			Sort:          order,
+			ShowHidden:    showHidden,
+			ChildCounts:   counts,
+		})
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 		writeJSON(w, node)
-	})
+	}))
+
+	mux.HandleFunc("/api/list", authorize(absDataDir, methodAccess{
+		http.MethodGet: {Action: ActionRead},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		query := r.URL.Query()
+		dirPath, err := resolvePath(absDataDir, query.Get("path"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		info, err := os.Stat(dirPath)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "directory not found")
+			return
+		}
+		if !info.IsDir() {
+			writeError(w, http.StatusBadRequest, "path is not a directory")
+			return
+		}
+		limit := defaultListLimit
+		if value := query.Get("limit"); value != "" {
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid limit")
+				return
+			}
+			if limit > maxListLimit {
+				limit = maxListLimit
+			}
+		}
+		order, err := parseNodeSort(query)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		counts, err := parseChildCounts(query)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// The cursor records the sort fields of the last entry already
+		// returned, so paging stays stable while entries come and go.
+		var after *Node
+		if cursor := query.Get("cursor"); cursor != "" {
+			node, err := decodeListCursor(cursor)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid cursor")
+				return
+			}
+			after = &node
+		}
 
-	mux.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
+		showHidden, ok := showHiddenEntries(w, r)
+		if !ok {
+			return
+		}
+		entries, err := listDir(absDataDir, dirPath, TreeOptions{
+			User:          requestUser(r),
+			ProtectedMode: protectedMode,
+			Sort:          order,
+			ShowHidden:    showHidden,
+			ChildCounts:   counts,
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		start := 0
+		if after != nil {
+			start = sort.Search(len(entries), func(i int) bool {
+				return order.less(*after, entries[i])
+			})
+		}
+		end := start + limit
+		nextCursor := ""
+		if end < len(entries) {
+			nextCursor = encodeListCursor(entries[end-1])
+		} else {
+			end = len(entries)
+		}
+		writeJSON(w, map[string]interface{}{
+			"path":        toRelative(absDataDir, dirPath),
+			"entries":     entries[start:end],
+			"next_cursor": nextCursor,
+		})
+	}))
+
+	mux.HandleFunc("/api/login", authorize(absDataDir, nil, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
@@ -107,18 +415,35 @@ func main() {
 		}
 		um := GetUserManager()
 		if um.Authenticate(req.Username, req.Password) {
-			token := GetSessionManager().CreateSession(req.Username)
-			writeJSON(w, map[string]string{"status": "success", "token": token, "username": req.Username})
+			token, err := GetSessionManager().CreateSession(req.Username)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "failed to create session")
+				return
+			}
+			user, _ := um.GetUser(req.Username)
+			writeJSON(w, map[string]string{"status": "success", "token": token, "username": req.Username, "role": string(user.Role)})
 			return
 		}
 		writeError(w, http.StatusUnauthorized, "invalid credentials")
-	})
+	}))
 
-	mux.HandleFunc("/api/permission", func(w http.ResponseWriter, r *http.Request) {
-		if !isAuthenticated(r) {
-			writeError(w, http.StatusUnauthorized, "unauthorized")
+	mux.HandleFunc("/api/logout", authorize(absDataDir, nil, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
 		}
+		if token := r.Header.Get("X-Session-Token"); token != "" {
+			GetSessionManager().DeleteSession(token)
+		}
+		writeJSON(w, map[string]string{"status": "logged out"})
+	}))
+
+	mux.HandleFunc("/api/permission", authorize(absDataDir, methodAccess{
+		http.MethodGet:    {Role: RoleViewer},
+		http.MethodPost:   {Role: RoleAdmin},
+		http.MethodDelete: {Role: RoleAdmin},
+		http.MethodPut:    {Role: RoleAdmin},
+	}, func(w http.ResponseWriter, r *http.Request) {
 		pm := GetPermissionManager()
 
 		switch r.Method {
@@ -130,7 +455,15 @@ func main() {
 				writeError(w, http.StatusBadRequest, "invalid request body")
 				return
 			}
-			if err := pm.AddPermission(req.Path); err != nil {
+			entry, err := req.entry()
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if !allowPath(w, r, entry.scope(), ActionAdmin) {
+				return
+			}
+			if err := pm.AddPermission(entry); err != nil {
 				writeError(w, http.StatusInternalServerError, err.Error())
 				return
 			}
@@ -141,7 +474,15 @@ func main() {
 				writeError(w, http.StatusBadRequest, "invalid request body")
 				return
 			}
-			if err := pm.RemovePermission(req.Path); err != nil {
+			entry, err := req.entry()
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if !allowPath(w, r, entry.scope(), ActionAdmin) {
+				return
+			}
+			if err := pm.RemovePermission(entry); err != nil {
 				writeError(w, http.StatusInternalServerError, err.Error())
 				return
 			}
@@ -155,9 +496,34 @@ func main() {
 		default:
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		}
-	})
+	}))
+
+	mux.HandleFunc("/api/permission/match", authorize(absDataDir, methodAccess{
+		http.MethodGet: {Role: RoleViewer},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		filePath, err := resolvePath(absDataDir, r.URL.Query().Get("path"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		relPath := toRelative(absDataDir, filePath)
+		pm := GetPermissionManager()
+		writeJSON(w, map[string]interface{}{
+			"path":      relPath,
+			"protected": pm.IsProtected(relPath),
+			"actions":   pm.Explain(requestUser(r), relPath),
+		})
+	}))
 
-	mux.HandleFunc("/api/file", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/file", authorize(absDataDir, methodAccess{
+		http.MethodGet:    {Action: ActionRead},
+		http.MethodPut:    {Role: RoleEditor, Action: ActionWrite},
+		http.MethodDelete: {Role: RoleEditor, Action: ActionDelete},
+	}, func(w http.ResponseWriter, r *http.Request) {
 		relPath := r.URL.Query().Get("path")
 		filePath, err := resolvePath(absDataDir, relPath)
 		if err != nil {
@@ -176,11 +542,6 @@ func main() {
 				writeError(w, http.StatusBadRequest, "path is a directory")
 				return
 			}
-			pm := GetPermissionManager()
-			if pm.HasPermission(relPath) && !isAuthenticated(r) {
-				writeError(w, http.StatusForbidden, "no permission")
-				return
-			}
 			data, err := os.ReadFile(filePath)
 			if err != nil {
 				writeError(w, http.StatusInternalServerError, err.Error())
@@ -188,53 +549,190 @@ func main() {
 			}
 			fileType := detectFileType(filePath)
 			resp := FileResponse{Type: fileType, Content: string(data), Name: info.Name()}
+			w.Header().Set("ETag", contentETag(data))
 			writeJSON(w, resp)
 		case http.MethodPut:
-			if !isAuthenticated(r) {
-				writeError(w, http.StatusUnauthorized, "unauthorized")
-				return
-			}
 			lower := strings.ToLower(filePath)
 			if !(strings.HasSuffix(lower, ".md") || strings.HasSuffix(lower, ".txt") || strings.HasSuffix(lower, ".json")) {
 				writeError(w, http.StatusBadRequest, "only markdown/txt/json files can be updated")
 				return
 			}
+			// A save through a symlink replaces the file it points to, so
+			// that file has to pass the policy and the ACL as well.
+			if linked, ok := linkTarget(absDataDir, toRelative(absDataDir, filePath)); ok {
+				if err := checkSymlinks(absDataDir, filepath.Join(absDataDir, filepath.FromSlash(linked))); err != nil {
+					writeError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				if !allowPath(w, r, linked, ActionWrite) {
+					return
+				}
+			}
 			body, err := io.ReadAll(r.Body)
 			if err != nil {
 				writeError(w, http.StatusBadRequest, "invalid body")
 				return
 			}
-			if err := os.WriteFile(filePath, body, 0o644); err != nil {
+			fileVersionMu.Lock()
+			defer fileVersionMu.Unlock()
+			if !checkIfMatch(w, r, filePath) {
+				return
+			}
+			if err := GetHistoryManager().SaveFile(filePath, toRelative(absDataDir, filePath), body, requestUser(r).Username); err != nil {
 				writeError(w, http.StatusInternalServerError, err.Error())
 				return
 			}
-			writeJSON(w, map[string]string{"status": "ok"})
+			GetSearchManager().Refresh(toRelative(absDataDir, filePath))
+			etag := contentETag(body)
+			w.Header().Set("ETag", etag)
+			writeJSON(w, map[string]string{"status": "ok", "etag": etag})
 		case http.MethodDelete:
-			if !isAuthenticated(r) {
-				writeError(w, http.StatusUnauthorized, "unauthorized")
+			if filePath == absDataDir {
+				writeError(w, http.StatusBadRequest, "cannot delete root directory")
 				return
 			}
-			if strings.TrimSpace(relPath) == "" {
-				writeError(w, http.StatusBadRequest, "cannot delete root directory")
+			fileVersionMu.Lock()
+			defer fileVersionMu.Unlock()
+			if !checkIfMatch(w, r, filePath) {
+				return
+			}
+			paths, err := subtreePaths(filePath)
+			if os.IsNotExist(err) {
+				writeError(w, http.StatusNotFound, "file not found")
+				return
+			} else if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
 				return
 			}
-			if err := os.RemoveAll(filePath); err != nil {
+			if !allowSubtree(w, r, toRelative(absDataDir, filePath), paths, ActionDelete) {
+				return
+			}
+			item, err := GetTrashManager().Move(toRelative(absDataDir, filePath), requestUser(r).Username)
+			if os.IsNotExist(err) {
+				writeError(w, http.StatusNotFound, "file not found")
+				return
+			} else if err != nil {
 				writeError(w, http.StatusInternalServerError, err.Error())
 				return
 			}
-			writeJSON(w, map[string]string{"status": "deleted"})
+			GetSearchManager().Refresh(item.OriginalPath)
+			writeJSON(w, map[string]string{"status": "deleted", "trash_id": item.ID})
 		default:
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		}
-	})
+	}))
 
-	mux.HandleFunc("/api/create", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/history", authorize(absDataDir, methodAccess{
+		http.MethodGet: {Role: RoleViewer, Action: ActionRead},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		filePath, err := resolvePath(absDataDir, r.URL.Query().Get("path"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		relPath := toRelative(absDataDir, filePath)
+		revisions, err := GetHistoryManager().List(relPath)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, map[string]interface{}{"path": relPath, "revisions": revisions})
+	}))
+
+	mux.HandleFunc("/api/history/revision", authorize(absDataDir, methodAccess{
+		http.MethodGet: {Role: RoleViewer, Action: ActionRead},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		filePath, err := resolvePath(absDataDir, r.URL.Query().Get("path"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if !validRevisionID(id) {
+			writeError(w, http.StatusBadRequest, "invalid revision id")
+			return
+		}
+		data, err := GetHistoryManager().Content(toRelative(absDataDir, filePath), id)
+		if errors.Is(err, errRevisionNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, FileResponse{Type: detectFileType(filePath), Content: string(data), Name: filepath.Base(filePath)})
+	}))
+
+	mux.HandleFunc("/api/history/restore", authorize(absDataDir, methodAccess{
+		http.MethodPost: {Role: RoleEditor},
+	}, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
 		}
-		if !isAuthenticated(r) {
-			writeError(w, http.StatusUnauthorized, "unauthorized")
+		var req HistoryRestoreRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		filePath, err := resolvePath(absDataDir, req.Path)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !validRevisionID(req.ID) {
+			writeError(w, http.StatusBadRequest, "invalid revision id")
+			return
+		}
+		relPath := toRelative(absDataDir, filePath)
+		if !allowPath(w, r, relPath, ActionWrite) {
+			return
+		}
+		if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+			writeError(w, http.StatusBadRequest, "path is a directory")
+			return
+		}
+		hm := GetHistoryManager()
+		data, err := hm.Content(relPath, req.ID)
+		if errors.Is(err, errRevisionNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		fileVersionMu.Lock()
+		defer fileVersionMu.Unlock()
+		if !checkIfMatch(w, r, filePath) {
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := hm.SaveFile(filePath, relPath, data, requestUser(r).Username); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		GetSearchManager().Refresh(relPath)
+		etag := contentETag(data)
+		w.Header().Set("ETag", etag)
+		writeJSON(w, map[string]string{"status": "restored", "path": relPath, "etag": etag})
+	}))
+
+	mux.HandleFunc("/api/create", authorize(absDataDir, methodAccess{
+		http.MethodPost: {Role: RoleEditor},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
 		}
 		var req CreateRequest
@@ -262,6 +760,9 @@ func main() {
 			return
 		}
 		targetPath := filepath.Join(parentPath, name)
+		if !allowPath(w, r, toRelative(absDataDir, targetPath), ActionWrite) {
+			return
+		}
 		switch strings.ToLower(req.Type) {
 		case "dir":
 			if err := os.MkdirAll(targetPath, 0o755); err != nil {
@@ -269,7 +770,7 @@ func main() {
 				return
 			}
 		case "file":
-			if err := os.WriteFile(targetPath, []byte(req.Content), 0o644); err != nil {
+			if err := writeFileAtomic(targetPath, []byte(req.Content), 0o644); err != nil {
 				writeError(w, http.StatusInternalServerError, err.Error())
 				return
 			}
@@ -277,10 +778,398 @@ func main() {
 			writeError(w, http.StatusBadRequest, "invalid type")
 			return
 		}
+		GetSearchManager().Refresh(toRelative(absDataDir, targetPath))
 		writeJSON(w, map[string]string{"status": "created", "path": toRelative(absDataDir, targetPath)})
-	})
+	}))
 
-	mux.HandleFunc("/api/raw", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/move", authorize(absDataDir, methodAccess{
+		http.MethodPost: {Role: RoleEditor},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var req MoveRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.Conflict == "" {
+			req.Conflict = conflictFail
+		}
+		if !validConflictPolicy(req.Conflict) {
+			writeError(w, http.StatusBadRequest, "invalid conflict policy")
+			return
+		}
+		sourcePath, err := resolvePath(absDataDir, req.Source)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		destPath, err := resolvePath(absDataDir, req.Destination)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if sourcePath == absDataDir || destPath == absDataDir {
+			writeError(w, http.StatusBadRequest, "cannot move root directory")
+			return
+		}
+		if sourcePath == destPath {
+			writeError(w, http.StatusBadRequest, "source and destination are the same")
+			return
+		}
+		if isWithin(destPath, sourcePath) {
+			writeError(w, http.StatusBadRequest, "cannot move a directory into itself")
+			return
+		}
+		if isWithin(sourcePath, destPath) {
+			writeError(w, http.StatusBadRequest, "cannot move a path onto a directory containing it")
+			return
+		}
+		if _, err := os.Lstat(sourcePath); err != nil {
+			writeError(w, http.StatusNotFound, "source not found")
+			return
+		}
+		info, err := os.Stat(filepath.Dir(destPath))
+		if err != nil || !info.IsDir() {
+			writeError(w, http.StatusBadRequest, "invalid destination directory")
+			return
+		}
+		paths, err := subtreePaths(sourcePath)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		sourceRel := toRelative(absDataDir, sourcePath)
+		if !allowSubtree(w, r, sourceRel, paths, ActionDelete) {
+			return
+		}
+		targetPath, replace, err := resolveConflict(destPath, req.Conflict)
+		if errors.Is(err, errTargetExists) {
+			writeError(w, http.StatusConflict, "destination already exists")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		targetRel := toRelative(absDataDir, targetPath)
+		if !allowSubtree(w, r, targetRel, paths, ActionWrite) {
+			return
+		}
+		if rule, pinned := GetPermissionManager().PinnedRule(sourceRel, targetRel, paths); pinned {
+			writeError(w, http.StatusConflict, fmt.Sprintf("rule %s would not cover the moved path", rule.Path))
+			return
+		}
+		if replace {
+			existing, err := subtreePaths(targetPath)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !allowSubtree(w, r, targetRel, existing, ActionDelete) {
+				return
+			}
+		}
+		if err := moveReplacing(sourcePath, targetPath, func() error {
+			if !replace {
+				return nil
+			}
+			_, err := GetTrashManager().Move(targetRel, requestUser(r).Username)
+			return err
+		}); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		GetSearchManager().Refresh(sourceRel)
+		GetSearchManager().Refresh(targetRel)
+		if err := GetPermissionManager().RenamePath(sourceRel, targetRel); err != nil {
+			writeError(w, http.StatusInternalServerError, "moved, but failed to update permissions: "+err.Error())
+			return
+		}
+		writeJSON(w, map[string]string{"status": "moved", "path": targetRel})
+	}))
+
+	mux.HandleFunc("/api/copy", authorize(absDataDir, methodAccess{
+		http.MethodPost: {Role: RoleEditor},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var req CopyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.Destination == "" {
+			req.Destination = req.Source
+		}
+		if req.Conflict == "" {
+			req.Conflict = conflictRename
+		}
+		if !validConflictPolicy(req.Conflict) {
+			writeError(w, http.StatusBadRequest, "invalid conflict policy")
+			return
+		}
+		sourcePath, err := resolvePath(absDataDir, req.Source)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		destPath, err := resolvePath(absDataDir, req.Destination)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if destPath == sourcePath && req.Conflict == conflictOverwrite {
+			writeError(w, http.StatusBadRequest, "source and destination are the same")
+			return
+		}
+		if destPath != sourcePath && isWithin(destPath, sourcePath) {
+			writeError(w, http.StatusBadRequest, "cannot copy a directory into itself")
+			return
+		}
+		if _, err := os.Lstat(sourcePath); err != nil {
+			writeError(w, http.StatusNotFound, "source not found")
+			return
+		}
+		info, err := os.Stat(filepath.Dir(destPath))
+		if err != nil || !info.IsDir() || destPath == absDataDir {
+			writeError(w, http.StatusBadRequest, "invalid destination directory")
+			return
+		}
+		entries, progress, err := planCopy(sourcePath)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		// The read check covers where symlinks in the tree lead, too. Their
+		// copies lead to the same places, so the symlink policy has to
+		// allow following them now, before they show up somewhere new.
+		paths := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			entryPath := filepath.Join(sourcePath, entry.rel)
+			if !allowPath(w, r, toRelative(absDataDir, entryPath), ActionRead) {
+				return
+			}
+			if entry.info.Mode()&os.ModeSymlink != 0 {
+				if err := checkSymlinks(absDataDir, entryPath); err != nil {
+					writeError(w, http.StatusBadRequest, fmt.Sprintf("%s: %v", toRelative(absDataDir, entryPath), err))
+					return
+				}
+			}
+			paths = append(paths, filepath.ToSlash(entry.rel))
+		}
+		targetPath, replace, err := resolveConflict(destPath, req.Conflict)
+		if errors.Is(err, errTargetExists) {
+			writeError(w, http.StatusConflict, "destination already exists")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		targetRel := toRelative(absDataDir, targetPath)
+		if !allowSubtree(w, r, targetRel, paths, ActionWrite) {
+			return
+		}
+		if replace {
+			existing, err := subtreePaths(targetPath)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !allowSubtree(w, r, targetRel, existing, ActionDelete) {
+				return
+			}
+		}
+
+		report := func() {}
+		if req.Progress {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			flusher, _ := w.(http.Flusher)
+			encoder := json.NewEncoder(w)
+			var last time.Time
+			report = func() {
+				done := progress.CopiedFiles == progress.TotalFiles
+				if !done && time.Since(last) < copyProgressInterval {
+					return
+				}
+				last = time.Now()
+				_ = encoder.Encode(map[string]interface{}{"progress": progress})
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			report()
+		}
+		// The destination only goes to the trash once the copy is complete.
+		err = copyTreeAtomic(sourcePath, targetPath, entries, &progress, report, func() error {
+			if !replace {
+				return nil
+			}
+			_, err := GetTrashManager().Move(targetRel, requestUser(r).Username)
+			return err
+		})
+		GetSearchManager().Refresh(targetRel)
+		if err != nil {
+			if req.Progress {
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, map[string]interface{}{"status": "copied", "path": targetRel, "progress": progress})
+	}))
+
+	mux.HandleFunc("/api/trash", authorize(absDataDir, methodAccess{
+		http.MethodGet:    {Role: RoleEditor},
+		http.MethodPost:   {Role: RoleEditor},
+		http.MethodDelete: {Role: RoleEditor},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		tm := GetTrashManager()
+		pm := GetPermissionManager()
+		user := requestUser(r)
+
+		switch r.Method {
+		case http.MethodGet:
+			items, err := tm.List()
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			visible := make([]TrashItem, 0, len(items))
+			for _, item := range items {
+				if pm.Check(user, item.OriginalPath, ActionRead) {
+					visible = append(visible, item)
+				}
+			}
+			writeJSON(w, map[string]interface{}{"items": visible, "retention": trashRetention.String()})
+		case http.MethodPost:
+			var req RestoreRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			if req.Conflict == "" {
+				req.Conflict = conflictFail
+			}
+			if !validConflictPolicy(req.Conflict) {
+				writeError(w, http.StatusBadRequest, "invalid conflict policy")
+				return
+			}
+			item, err := tm.Get(req.ID)
+			if errors.Is(err, errTrashItemNotFound) {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			} else if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			originalPath, err := resolvePath(absDataDir, item.OriginalPath)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			// Restoring must not bring back anything the caller could not
+			// read where it was deleted.
+			paths, err := tm.Contents(item)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !allowSubtree(w, r, item.OriginalPath, paths, ActionRead) {
+				return
+			}
+			targetPath, replace, err := resolveConflict(originalPath, req.Conflict)
+			if errors.Is(err, errTargetExists) {
+				writeError(w, http.StatusConflict, "original path is in use")
+				return
+			} else if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			targetRel := toRelative(absDataDir, targetPath)
+			if !allowSubtree(w, r, targetRel, paths, ActionWrite) {
+				return
+			}
+			if targetRel != item.OriginalPath {
+				if rule, pinned := pm.PinnedRule(item.OriginalPath, targetRel, paths); pinned {
+					writeError(w, http.StatusConflict, fmt.Sprintf("rule %s would not cover the item at %s", rule.Path, targetRel))
+					return
+				}
+			}
+			if replace {
+				existing, err := subtreePaths(targetPath)
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				if !allowSubtree(w, r, targetRel, existing, ActionDelete) {
+					return
+				}
+				if _, err := tm.Move(targetRel, user.Username); err != nil {
+					writeError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+			}
+			if err := tm.Restore(item, targetPath); err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			GetSearchManager().Refresh(targetRel)
+			if targetRel != item.OriginalPath {
+				if err := pm.RenamePath(item.OriginalPath, targetRel); err != nil {
+					writeError(w, http.StatusInternalServerError, "restored, but failed to update permissions: "+err.Error())
+					return
+				}
+			}
+			writeJSON(w, map[string]string{"status": "restored", "path": targetRel})
+		case http.MethodDelete:
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				if !user.Role.Allows(RoleAdmin) {
+					writeError(w, http.StatusForbidden, "insufficient role")
+					return
+				}
+				purged, err := tm.PurgeOlderThan(time.Now())
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+				writeJSON(w, map[string]interface{}{"status": "emptied", "purged": purged})
+				return
+			}
+			item, err := tm.Get(id)
+			if errors.Is(err, errTrashItemNotFound) {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			} else if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			paths, err := tm.Contents(item)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if !allowSubtree(w, r, item.OriginalPath, paths, ActionDelete) {
+				return
+			}
+			if err := tm.Purge(id); err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, map[string]string{"status": "purged"})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}))
+
+	mux.HandleFunc("/api/raw", authorize(absDataDir, methodAccess{
+		http.MethodGet: {Action: ActionRead},
+	}, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
@@ -305,9 +1194,52 @@ func main() {
 			w.Header().Set("Content-Type", contentType)
 		}
 		http.ServeFile(w, r, filePath)
-	})
+	}))
 
-	mux.HandleFunc("/api/upload", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/search", authorize(absDataDir, methodAccess{
+		http.MethodGet: {Action: ActionRead},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		query := r.URL.Query()
+		scopePath, err := resolvePath(absDataDir, query.Get("path"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		parsed := parseSearchQuery(query.Get("q"))
+		if len(parsed.clauses) == 0 {
+			writeError(w, http.StatusBadRequest, "empty query")
+			return
+		}
+		showHidden, ok := showHiddenEntries(w, r)
+		if !ok {
+			return
+		}
+		limit := defaultSearchLimit
+		if value := query.Get("limit"); value != "" {
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid limit")
+				return
+			}
+			if limit > maxSearchLimit {
+				limit = maxSearchLimit
+			}
+		}
+		results, total := GetSearchManager().Search(parsed, toRelative(absDataDir, scopePath), requestUser(r), showHidden, limit)
+		writeJSON(w, map[string]interface{}{
+			"query":   query.Get("q"),
+			"total":   total,
+			"results": results,
+		})
+	}))
+
+	mux.HandleFunc("/api/upload", authorize(absDataDir, methodAccess{
+		http.MethodPost: {Role: RoleEditor, Action: ActionWrite},
+	}, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
@@ -323,43 +1255,106 @@ func main() {
 			writeError(w, http.StatusBadRequest, "invalid directory")
 			return
 		}
-		if err := r.ParseMultipartForm(20 << 20); err != nil {
-			writeError(w, http.StatusBadRequest, "failed to parse form")
-			return
+		conflict := r.URL.Query().Get("conflict")
+		if conflict == "" {
+			conflict = conflictRename
 		}
-		file, header, err := r.FormFile("file")
-		if err != nil {
-			writeError(w, http.StatusBadRequest, "missing file")
+		if !validConflictPolicy(conflict) {
+			writeError(w, http.StatusBadRequest, "invalid conflict policy")
 			return
 		}
-		defer file.Close()
-		filename := filepath.Base(header.Filename)
-		if filename == "." || filename == string(filepath.Separator) {
-			writeError(w, http.StatusBadRequest, "invalid filename")
-			return
+		if uploadMaxSize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, uploadMaxSize)
 		}
-		targetPath := filepath.Join(dirPath, filename)
-		out, err := os.Create(targetPath)
+		reader, err := r.MultipartReader()
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err.Error())
+			writeError(w, http.StatusBadRequest, "failed to parse form")
 			return
 		}
-		defer out.Close()
-		if _, err := io.Copy(out, file); err != nil {
-			writeError(w, http.StatusInternalServerError, err.Error())
+		dirRel := toRelative(absDataDir, dirPath)
+		user := requestUser(r)
+
+		var results []UploadResult
+		failed := 0
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeJSONStatus(w, http.StatusRequestEntityTooLarge, map[string]interface{}{
+					"error": fmt.Sprintf("upload exceeds the limit of %d bytes", tooLarge.Limit),
+					"files": results,
+				})
+				return
+			} else if err != nil {
+				writeError(w, http.StatusBadRequest, "failed to parse form")
+				return
+			}
+			if part.FileName() == "" {
+				part.Close()
+				continue
+			}
+			result := storeUpload(absDataDir, dirRel, user, uploadFileName(part.Header), conflict, part)
+			part.Close()
+			results = append(results, result)
+			if result.code == http.StatusRequestEntityTooLarge {
+				// The rest of the body is cut off.
+				writeJSONStatus(w, http.StatusRequestEntityTooLarge, map[string]interface{}{"error": result.Error, "files": results})
+				return
+			}
+			if result.Status != "uploaded" {
+				failed++
+			}
+		}
+		if len(results) == 0 {
+			writeError(w, http.StatusBadRequest, "missing file")
 			return
 		}
-		writeJSON(w, map[string]string{"status": "uploaded", "path": toRelative(absDataDir, targetPath)})
-	})
+		switch {
+		case failed == len(results):
+			message := results[0].Error
+			if len(results) > 1 {
+				message = "no file was uploaded"
+			}
+			writeJSONStatus(w, uploadFailureStatus(results), map[string]interface{}{"error": message, "files": results})
+		case failed > 0:
+			writeJSON(w, map[string]interface{}{"status": "partial", "files": results})
+		default:
+			writeJSON(w, map[string]interface{}{"status": "uploaded", "files": results})
+		}
+	}))
 
-	staticDir := filepath.Join(".", "frontend", "dist")
-	mux.Handle("/", spaHandler(staticDir))
+	tus := authorize(absDataDir, methodAccess{
+		http.MethodPost:   {Role: RoleEditor},
+		http.MethodHead:   {Role: RoleEditor},
+		http.MethodPatch:  {Role: RoleEditor},
+		http.MethodDelete: {Role: RoleEditor},
+	}, tusHandler(absDataDir))
+	mux.HandleFunc(strings.TrimSuffix(tusBasePath, "/"), tus)
+	mux.HandleFunc(tusBasePath, tus)
 
-	addr := ":8080"
-	fmt.Printf("File manager running on %s (data dir: %s)\n", addr, absDataDir)
-	if err := http.ListenAndServe(addr, withCORS(mux)); err != nil {
-		panic(err)
+	mux.Handle("/", spaHandler(cfg.StaticDir))
+	return withCORS(mux)
+}
+
+// showHiddenEntries reads the hidden query parameter, which only admins may
+// set, and writes an error response if it is not acceptable.
+func showHiddenEntries(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	switch r.URL.Query().Get("hidden") {
+	case "", "false", "0":
+		return false, true
+	case "true", "1":
+	default:
+		writeError(w, http.StatusBadRequest, "invalid hidden")
+		return false, false
 	}
+	if user := requestUser(r); user == nil || !user.Role.Allows(RoleAdmin) {
+		writeError(w, http.StatusForbidden, "insufficient role")
+		return false, false
+	}
+	return true, true
 }
 
 func resolvePath(baseDir, relPath string) (string, error) {
@@ -373,6 +1368,12 @@ func resolvePath(baseDir, relPath string) (string, error) {
 	if absTarget != baseDir && !strings.HasPrefix(absTarget, baseDir+string(filepath.Separator)) {
 		return "", errors.New("invalid path")
 	}
+	if isWithin(absTarget, filepath.Join(baseDir, systemDirName)) {
+		return "", errors.New("invalid path")
+	}
+	if err := checkSymlinks(baseDir, absTarget); err != nil {
+		return "", err
+	}
 	return absTarget, nil
 }
 
@@ -387,38 +1388,114 @@ func toRelative(baseDir, absPath string) string {
 	return filepath.ToSlash(rel)
 }
 
-func buildTree(baseDir, rootPath string) (Node, error) {
+// buildTree lists rootPath down to opts.Depth levels. Entries opts.User may
+// not read are either dropped or reported as locked nodes, so their
+// contents are never revealed. Directories below the depth limit come
+// without children; clients fetch them with /api/list when needed, as do
+// symlinked directories that lead back to one of their ancestors.
+func buildTree(baseDir, rootPath string, opts TreeOptions) (Node, error) {
 	info, err := os.Stat(rootPath)
 	if err != nil {
 		return Node{}, err
 	}
-	node := Node{
-		Name: info.Name(),
-		Path: toRelative(baseDir, rootPath),
-		Type: "file",
+	node := newNode(baseDir, rootPath, info, resolveEntryLink(baseDir, toRelative(baseDir, rootPath)), opts)
+	if linkInfo, err := os.Lstat(rootPath); err == nil && linkInfo.Mode()&os.ModeSymlink != 0 {
+		node.Symlink = true
 	}
-	if info.IsDir() {
-		entries, err := os.ReadDir(rootPath)
-		if err != nil {
-			return Node{}, err
+	if node.Locked || !info.IsDir() || opts.Depth == 0 {
+		return node, nil
+	}
+	for _, ancestor := range opts.ancestors {
+		if os.SameFile(info, ancestor) {
+			return node, nil
 		}
-		sort.Slice(entries, func(i, j int) bool {
-			return strings.ToLower(entries[i].Name()) < strings.ToLower(entries[j].Name())
-		})
-		node.Type = "dir"
-		node.Children = make([]Node, 0, len(entries))
-		for _, entry := range entries {
-			childPath := filepath.Join(rootPath, entry.Name())
-			childNode, err := buildTree(baseDir, childPath)
+	}
+
+	children, err := listDir(baseDir, rootPath, opts)
+	if err != nil {
+		return Node{}, err
+	}
+	childOpts := opts
+	if childOpts.Depth > 0 {
+		childOpts.Depth--
+	}
+	childOpts.ancestors = append(opts.ancestors[:len(opts.ancestors):len(opts.ancestors)], info)
+	node.Children = make([]Node, 0, len(children))
+	for _, child := range children {
+		if child.Type == "dir" && !child.Locked && child.NodeMeta != nil && childOpts.Depth != 0 {
+			child, err = buildTree(baseDir, filepath.Join(baseDir, filepath.FromSlash(child.Path)), childOpts)
 			if err != nil {
 				return Node{}, err
 			}
-			node.Children = append(node.Children, childNode)
 		}
+		node.Children = append(node.Children, child)
 	}
 	return node, nil
 }
 
+// listDir returns the entries of dirPath as nodes without children, in
+// opts.Sort order. Entries opts.User may not read are locked or left out
+// as in buildTree, and entries matched by .fmignore rules are skipped
+// unless opts.ShowHidden is set. Symlinks are marked; those the symlink
+// policy does not let us follow are listed without metadata.
+func listDir(baseDir, dirPath string, opts TreeOptions) ([]Node, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	ignore := GetIgnoreManager().ForDir(toRelative(baseDir, dirPath))
+	dirLink := resolveEntryLink(baseDir, toRelative(baseDir, dirPath))
+	nodes := make([]Node, 0, len(entries))
+	for _, entry := range entries {
+		childPath := filepath.Join(dirPath, entry.Name())
+		if childPath == filepath.Join(baseDir, systemDirName) {
+			continue
+		}
+		isLink := entry.Type()&os.ModeSymlink != 0
+		childRel := toRelative(baseDir, childPath)
+		link := dirLink.child(baseDir, childRel, entry.Name(), isLink)
+		var info os.FileInfo
+		if !isLink || checkSymlinks(baseDir, childPath) == nil {
+			if info, err = os.Stat(childPath); err != nil && !isLink {
+				return nil, err
+			}
+		}
+		var node Node
+		if info == nil {
+			if !opts.ShowHidden && ignore.ignored(childRel, false) {
+				continue
+			}
+			node = Node{Name: entry.Name(), Path: childRel, Type: "file"}
+			readable, protected := GetPermissionManager().ReadAccess(opts.User, childRel, link.target, link.through)
+			node.Protected, node.Locked = protected, !readable
+		} else {
+			if !opts.ShowHidden && ignore.ignored(childRel, info.IsDir()) {
+				continue
+			}
+			node = newNode(baseDir, childPath, info, link, opts)
+		}
+		node.Symlink = isLink
+		if node.Locked && opts.ProtectedMode == protectedHide {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return opts.Sort.less(nodes[i], nodes[j])
+	})
+	return nodes, nil
+}
+
+// nameLess orders names case-insensitively, falling back to a byte-wise
+// comparison so the order is total and usable as a paging cursor.
+func nameLess(a, b string) bool {
+	lowerA, lowerB := strings.ToLower(a), strings.ToLower(b)
+	if lowerA != lowerB {
+		return lowerA < lowerB
+	}
+	return a < b
+}
+
 func detectFileType(path string) string {
 	switch strings.ToLower(filepath.Ext(path)) {
 	case ".md", ".markdown":
@@ -456,9 +1533,11 @@ func spaHandler(distDir string) http.Handler {
 func withCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Session-Token")
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,OPTIONS")
-		if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Session-Token, If-Match, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Metadata, Upload-Expires")
+		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,HEAD,DELETE,OPTIONS")
+		// tus clients discover the server's capabilities with OPTIONS.
+		if r.Method == http.MethodOptions && !strings.HasPrefix(r.URL.Path, tusBasePath) && r.URL.Path != strings.TrimSuffix(tusBasePath, "/") {
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
@@ -477,18 +1556,8 @@ func writeJSON(w http.ResponseWriter, data interface{}) {
 	_ = json.NewEncoder(w).Encode(data)
 }
 
-func isAuthenticated(r *http.Request) bool {
-	token := r.Header.Get("X-Session-Token")
-	if token == "" {
-		return false
-	}
-	
-	um := GetUserManager()
-	if err := um.checkFileModified(); err != nil {
-		fmt.Printf("User file modified: %v\n", err)
-		GetSessionManager().ClearAllSessions()
-		return false
-	}
-	
-	return GetSessionManager().ValidateAndTouch(token)
+func writeJSONStatus(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
 }
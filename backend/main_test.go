@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestDataDir points the file managers at a fresh data dir guarded by
+// rules and returns its path. Their background jobs are stopped when the
+// test ends, before the next test replaces the managers.
+func newTestDataDir(t *testing.T, rules ...string) string {
+	t.Helper()
+	dataDir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestPermissionManager(t, dataDir, rules...)
+	if err := InitTrashManager(dataDir, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(GetTrashManager().Close)
+	if err := InitHistoryManager(dataDir, defaultHistoryMaxRevisions); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(GetHistoryManager().Close)
+	if err := InitTusManager(dataDir, time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(GetTusManager().Close)
+	InitIgnoreManager(dataDir, defaultIgnorePatterns)
+	InitSearchManager(dataDir)
+	t.Cleanup(GetSearchManager().Close)
+	return dataDir
+}
+
+// writeTestFile creates a file below dataDir, with its parent directories.
+func writeTestFile(t *testing.T, dataDir, relPath, content string) {
+	t.Helper()
+	filePath := filepath.Join(dataDir, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test clients, in the order statusByClient lists them.
+var testClients = []struct {
+	name string
+	user string
+}{
+	{"anonymous", ""},
+	{"viewer", "viewer"},
+	{"editor", "editor"},
+	{"admin", "admin"},
+}
+
+// statusByClient is the expected status per test client, for the
+// unprotected and the protected fixture directory.
+type statusByClient [4][2]int
+
+func sameForAll(status int) statusByClient {
+	return statusByClient{{status, status}, {status, status}, {status, status}, {status, status}}
+}
+
+var (
+	// readable paths: anonymous callers are kept out of the protected one.
+	readable = statusByClient{
+		{http.StatusOK, http.StatusForbidden},
+		{http.StatusOK, http.StatusOK},
+		{http.StatusOK, http.StatusOK},
+		{http.StatusOK, http.StatusOK},
+	}
+	// viewerOnly endpoints need a login.
+	viewerOnly = statusByClient{
+		{http.StatusUnauthorized, http.StatusUnauthorized},
+		{http.StatusOK, http.StatusOK},
+		{http.StatusOK, http.StatusOK},
+		{http.StatusOK, http.StatusOK},
+	}
+	adminOnly = statusByClient{
+		{http.StatusUnauthorized, http.StatusUnauthorized},
+		{http.StatusForbidden, http.StatusForbidden},
+		{http.StatusForbidden, http.StatusForbidden},
+		{http.StatusOK, http.StatusOK},
+	}
+)
+
+// editorOnly is for endpoints that change files and answer status.
+func editorOnly(status int) statusByClient {
+	return statusByClient{
+		{http.StatusUnauthorized, http.StatusUnauthorized},
+		{http.StatusForbidden, http.StatusForbidden},
+		{status, status},
+		{status, status},
+	}
+}
+
+// newTestServer serves dataDir with the routes main registers.
+func newTestServer(t *testing.T, dataDir string) http.Handler {
+	t.Helper()
+	return newServer(serverConfig{
+		DataDir:        dataDir,
+		StaticDir:      t.TempDir(),
+		ProtectedMode:  protectedLock,
+		TrashRetention: time.Hour,
+		UploadMaxSize:  1 << 20,
+	})
+}
+
+// newTestFixture fills a data dir guarded by "/private" with the same
+// files below public/ and private/ and returns it.
+func newTestFixture(t *testing.T) string {
+	t.Helper()
+	dataDir := newTestDataDir(t, "/private")
+	for _, dir := range []string{"public", "private"} {
+		writeTestFile(t, dataDir, dir+"/a.md", "needle v1")
+		writeTestFile(t, dataDir, dir+"/pic.png", "png")
+		writeTestFile(t, dataDir, dir+"/sub/b.txt", "b")
+		for _, name := range []string{"del.md", "mv.md", "trash1.md", "trash2.md"} {
+			writeTestFile(t, dataDir, dir+"/"+name, name)
+		}
+		filePath := filepath.Join(dataDir, dir, "a.md")
+		if err := GetHistoryManager().SaveFile(filePath, dir+"/a.md", []byte("needle v2"), "admin"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	GetSearchManager().Refresh("")
+	return dataDir
+}
+
+func jsonBody(t *testing.T, v interface{}) io.Reader {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(data)
+}
+
+// testRequest is what an endpoint case sends for fixture directory dir.
+type testRequest struct {
+	target string
+	body   io.Reader
+	header http.Header
+}
+
+// TestEndpointAccess runs every route against one fixture per client and
+// directory, in table order. Rows that change the data dir work on files
+// of their own, and the rows rewriting .permissions come last.
+func TestEndpointAccess(t *testing.T) {
+	newTestUsers(t, map[string]Role{"viewer": RoleViewer, "editor": RoleEditor})
+
+	tests := []struct {
+		name    string
+		method  string
+		request func(t *testing.T, dir string) testRequest
+		want    statusByClient
+	}{
+		{"tree", http.MethodGet, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/tree?path=" + dir}
+		}, readable},
+		{"list", http.MethodGet, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/list?path=" + dir}
+		}, readable},
+		{"read file", http.MethodGet, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/file?path=" + dir + "/a.md"}
+		}, readable},
+		{"raw", http.MethodGet, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/raw?path=" + dir + "/pic.png"}
+		}, readable},
+		{"search", http.MethodGet, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/search?q=needle&path=" + dir}
+		}, readable},
+		{"history", http.MethodGet, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/history?path=" + dir + "/a.md"}
+		}, viewerOnly},
+		{"history revision", http.MethodGet, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/history/revision?path=" + dir + "/a.md&id=" + firstRevision(t, dir+"/a.md")}
+		}, viewerOnly},
+		{"save file", http.MethodPut, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/file?path=" + dir + "/a.md", body: strings.NewReader("saved")}
+		}, editorOnly(http.StatusOK)},
+		{"history restore", http.MethodPost, func(t *testing.T, dir string) testRequest {
+			id := firstRevision(t, dir+"/a.md")
+			return testRequest{target: "/api/history/restore", body: jsonBody(t, HistoryRestoreRequest{Path: dir + "/a.md", ID: id})}
+		}, editorOnly(http.StatusOK)},
+		{"history restore with stale If-Match", http.MethodPost, func(t *testing.T, dir string) testRequest {
+			id := firstRevision(t, dir+"/a.md")
+			return testRequest{
+				target: "/api/history/restore",
+				body:   jsonBody(t, HistoryRestoreRequest{Path: dir + "/a.md", ID: id}),
+				header: http.Header{"If-Match": {`"stale"`}},
+			}
+		}, editorOnly(http.StatusPreconditionFailed)},
+		{"delete file", http.MethodDelete, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/file?path=" + dir + "/del.md"}
+		}, editorOnly(http.StatusOK)},
+		{"upload", http.MethodPost, func(t *testing.T, dir string) testRequest {
+			var body bytes.Buffer
+			form := multipart.NewWriter(&body)
+			part, err := form.CreateFormFile("file", "up.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			part.Write([]byte("uploaded"))
+			form.Close()
+			header := http.Header{"Content-Type": {form.FormDataContentType()}}
+			return testRequest{target: "/api/upload?path=" + dir, body: &body, header: header}
+		}, editorOnly(http.StatusOK)},
+		{"create", http.MethodPost, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/create", body: jsonBody(t, CreateRequest{Parent: dir, Name: "new.md", Type: "file"})}
+		}, editorOnly(http.StatusOK)},
+		{"move", http.MethodPost, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/move", body: jsonBody(t, MoveRequest{Source: dir + "/mv.md", Destination: dir + "/moved.md"})}
+		}, editorOnly(http.StatusOK)},
+		{"copy", http.MethodPost, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/copy", body: jsonBody(t, CopyRequest{Source: dir + "/sub", Destination: dir + "/copied"})}
+		}, editorOnly(http.StatusOK)},
+		{"list trash", http.MethodGet, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/trash"}
+		}, editorOnly(http.StatusOK)},
+		{"restore from trash", http.MethodPost, func(t *testing.T, dir string) testRequest {
+			item, err := GetTrashManager().Move(dir+"/trash1.md", "admin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return testRequest{target: "/api/trash", body: jsonBody(t, RestoreRequest{ID: item.ID})}
+		}, editorOnly(http.StatusOK)},
+		{"purge from trash", http.MethodDelete, func(t *testing.T, dir string) testRequest {
+			item, err := GetTrashManager().Move(dir+"/trash2.md", "admin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return testRequest{target: "/api/trash?id=" + item.ID}
+		}, editorOnly(http.StatusOK)},
+		{"tus options", http.MethodOptions, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/tus"}
+		}, sameForAll(http.StatusNoContent)},
+		{"tus create", http.MethodPost, func(t *testing.T, dir string) testRequest {
+			header := http.Header{
+				"Tus-Resumable":   {tusVersion},
+				"Upload-Length":   {"5"},
+				"Upload-Metadata": {"filename " + base64.StdEncoding.EncodeToString([]byte("t.txt"))},
+			}
+			return testRequest{target: "/api/tus?path=" + dir, header: header}
+		}, editorOnly(http.StatusCreated)},
+		{"tus offset of own upload", http.MethodHead, func(t *testing.T, dir string) testRequest {
+			upload, err := GetTusManager().Create(dir+"/t.txt", "editor", conflictRename, 5, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return testRequest{target: tusBasePath + upload.ID, header: http.Header{"Tus-Resumable": {tusVersion}}}
+		}, statusByClient{
+			{http.StatusUnauthorized, http.StatusUnauthorized},
+			{http.StatusForbidden, http.StatusForbidden},
+			{http.StatusOK, http.StatusOK},
+			{http.StatusNotFound, http.StatusNotFound},
+		}},
+		{"list permissions", http.MethodGet, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/permission"}
+		}, viewerOnly},
+		{"match permission", http.MethodGet, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/permission/match?path=" + dir + "/a.md"}
+		}, viewerOnly},
+		{"add permission", http.MethodPost, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/permission", body: jsonBody(t, map[string]string{"path": "/" + dir + "/sub", "subject": "authenticated", "actions": "r"})}
+		}, adminOnly},
+		{"remove permission", http.MethodDelete, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/permission", body: jsonBody(t, map[string]string{"path": "/" + dir, "subject": ""})}
+		}, adminOnly},
+		{"clear permissions", http.MethodPut, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/permission"}
+		}, adminOnly},
+		{"login", http.MethodPost, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/login", body: jsonBody(t, LoginRequest{Username: "editor", Password: "wrong"})}
+		}, sameForAll(http.StatusUnauthorized)},
+		{"logout", http.MethodPost, func(t *testing.T, dir string) testRequest {
+			return testRequest{target: "/api/logout"}
+		}, sameForAll(http.StatusOK)},
+	}
+	for i, client := range testClients {
+		for j, dir := range []string{"public", "private"} {
+			t.Run(client.name+"/"+dir, func(t *testing.T) {
+				dataDir := newTestFixture(t)
+				server := newTestServer(t, dataDir)
+				for _, tt := range tests {
+					req := tt.request(t, dir)
+					r := httptest.NewRequest(tt.method, req.target, req.body)
+					for key, values := range req.header {
+						r.Header[key] = values
+					}
+					if client.user != "" {
+						token, err := GetSessionManager().CreateSession(client.user)
+						if err != nil {
+							t.Fatal(err)
+						}
+						r.Header.Set("X-Session-Token", token)
+					}
+					w := httptest.NewRecorder()
+					server.ServeHTTP(w, r)
+					if want := tt.want[i][j]; w.Code != want {
+						t.Errorf("%s: %s %s = %d, want %d: %s", tt.name, tt.method, req.target, w.Code, want, w.Body.String())
+					}
+				}
+			})
+		}
+	}
+}
+
+// newTestUsers installs a user manager holding the default admin and
+// users, and returns a fresh session token for each of them and admin.
+func newTestUsers(t *testing.T, users map[string]Role) map[string]string {
+	t.Helper()
+	if err := InitUserManager(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	InitSessionManager(newMemorySessionStore())
+	t.Cleanup(GetSessionManager().Close)
+	tokens := make(map[string]string, len(users)+1)
+	for username, role := range users {
+		if err := GetUserManager().AddUser(username, "secret", role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, username := range append(sortedKeys(users), "admin") {
+		token, err := GetSessionManager().CreateSession(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[username] = token
+	}
+	return tokens
+}
+
+func sortedKeys(users map[string]Role) []string {
+	keys := make([]string, 0, len(users))
+	for key := range users {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// serve sends a request to server as the holder of token, anonymously
+// when token is empty.
+func serve(server http.Handler, method, target string, body io.Reader, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	if token != "" {
+		r.Header.Set("X-Session-Token", token)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	return w
+}
+
+// TestPermissionEditsNeedAdmin checks that the ACL admin bit on a scope
+// does not let a non-admin role rewrite the rules.
+func TestPermissionEditsNeedAdmin(t *testing.T) {
+	tokens := newTestUsers(t, map[string]Role{"alice": RoleEditor})
+	dataDir := newTestDataDir(t, "/team user:alice rwda")
+	writeTestFile(t, dataDir, "team/a.txt", "a")
+	server := newTestServer(t, dataDir)
+	alice, _ := GetUserManager().GetUser("alice")
+	if !GetPermissionManager().Check(&alice, "team", ActionAdmin) {
+		t.Fatal("alice lacks the admin bit on /team")
+	}
+
+	add := map[string]string{"path": "/team/sub", "subject": "authenticated", "actions": "r"}
+	remove := map[string]string{"path": "/team", "subject": "user:alice", "actions": "rwda"}
+	for _, tt := range []struct {
+		method string
+		body   map[string]string
+	}{
+		{http.MethodPost, add},
+		{http.MethodDelete, remove},
+	} {
+		w := serve(server, tt.method, "/api/permission", jsonBody(t, tt.body), tokens["alice"])
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s as editor: status = %d, want %d: %s", tt.method, w.Code, http.StatusForbidden, w.Body.String())
+		}
+	}
+	if got := len(GetPermissionManager().ListPermissions()); got != 1 {
+		t.Fatalf("editor changed the rules: %d rule(s), want 1", got)
+	}
+	if w := serve(server, http.MethodPost, "/api/permission", jsonBody(t, add), tokens["admin"]); w.Code != http.StatusOK {
+		t.Fatalf("POST as admin: status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve(server, http.MethodDelete, "/api/permission", jsonBody(t, remove), tokens["admin"]); w.Code != http.StatusOK {
+		t.Fatalf("DELETE as admin: status = %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRecursiveOperationsCheckEveryPath(t *testing.T) {
+	tokens := newTestUsers(t, map[string]Role{"alice": RoleEditor, "bob": RoleEditor})
+	dataDir := newTestDataDir(t, "/public/secret user:alice rwd")
+	writeTestFile(t, dataDir, "public/a.txt", "a")
+	writeTestFile(t, dataDir, "public/secret/s.txt", "TOPSECRET")
+	server := newTestServer(t, dataDir)
+	expect := func(w *httptest.ResponseRecorder, want int) {
+		t.Helper()
+		if w.Code != want {
+			t.Fatalf("status = %d, want %d: %s", w.Code, want, w.Body.String())
+		}
+	}
+
+	expect(serve(server, http.MethodDelete, "/api/file?path=public", nil, tokens["bob"]), http.StatusForbidden)
+	expect(serve(server, http.MethodPost, "/api/copy", jsonBody(t, CopyRequest{Source: "public/a.txt", Destination: "public", Conflict: conflictOverwrite}), tokens["bob"]), http.StatusForbidden)
+
+	w := serve(server, http.MethodDelete, "/api/file?path=public", nil, tokens["alice"])
+	expect(w, http.StatusOK)
+	var deleted struct {
+		TrashID string `json:"trash_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &deleted); err != nil {
+		t.Fatal(err)
+	}
+	restore := RestoreRequest{ID: deleted.TrashID, Conflict: conflictRename}
+	expect(serve(server, http.MethodDelete, "/api/trash?id="+deleted.TrashID, nil, tokens["bob"]), http.StatusForbidden)
+	expect(serve(server, http.MethodPost, "/api/trash", jsonBody(t, restore), tokens["bob"]), http.StatusForbidden)
+
+	// With public taken, the restore lands next to it and the rule has to
+	// follow.
+	if err := os.Mkdir(filepath.Join(dataDir, "public"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	expect(serve(server, http.MethodPost, "/api/trash", jsonBody(t, restore), tokens["alice"]), http.StatusOK)
+	secret := "/api/file?path=" + url.QueryEscape("public (1)/secret/s.txt")
+	expect(serve(server, http.MethodGet, secret, nil, tokens["bob"]), http.StatusForbidden)
+	expect(serve(server, http.MethodGet, secret, nil, tokens["alice"]), http.StatusOK)
+}
+
+func TestMove(t *testing.T) {
+	tokens := newTestUsers(t, map[string]Role{"alice": RoleEditor, "bob": RoleEditor})
+	tests := []struct {
+		name     string
+		user     string
+		req      MoveRequest
+		want     int
+		wantFile string // relative path that must hold "b" afterwards
+	}{
+		{"onto own parent", "admin", MoveRequest{Source: "a/b", Destination: "a", Conflict: conflictOverwrite}, http.StatusBadRequest, "a/b/b.txt"},
+		{"into itself", "admin", MoveRequest{Source: "a", Destination: "a/b/c"}, http.StatusBadRequest, "a/b/b.txt"},
+		{"overwrite", "bob", MoveRequest{Source: "a/b/b.txt", Destination: "a/a.txt", Conflict: conflictOverwrite}, http.StatusOK, "a/a.txt"},
+		{"parent of a glob-protected dir", "bob", MoveRequest{Source: "public", Destination: "archive"}, http.StatusForbidden, "public/secret/s.txt"},
+		{"glob rule cannot follow", "alice", MoveRequest{Source: "public", Destination: "archive"}, http.StatusConflict, "public/secret/s.txt"},
+		{"glob rule still covers the target", "alice", MoveRequest{Source: "public/secret/s.txt", Destination: "public/secret/t.txt"}, http.StatusOK, "public/secret/t.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := newTestDataDir(t, "/public/secret/** user:alice rwd")
+			writeTestFile(t, dataDir, "a/a.txt", "a")
+			writeTestFile(t, dataDir, "a/b/b.txt", "b")
+			writeTestFile(t, dataDir, "public/secret/s.txt", "b")
+			server := newTestServer(t, dataDir)
+
+			w := serve(server, http.MethodPost, "/api/move", jsonBody(t, tt.req), tokens[tt.user])
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			data, err := os.ReadFile(filepath.Join(dataDir, filepath.FromSlash(tt.wantFile)))
+			if err != nil || string(data) != "b" {
+				t.Errorf("%s = %q, %v; want %q", tt.wantFile, data, err, "b")
+			}
+		})
+	}
+}
+
+func TestSaveThroughSymlink(t *testing.T) {
+	tokens := newTestUsers(t, map[string]Role{"alice": RoleEditor, "bob": RoleEditor})
+	dataDir := newTestDataDir(t, "/real user:alice rwd")
+	writeTestFile(t, dataDir, "real/n.md", "orig")
+	writeTestFile(t, dataDir, "pub/.keep", "")
+	link := filepath.Join(dataDir, "pub", "n.md")
+	mustSymlink(t, "../real/n.md", link)
+	server := newTestServer(t, dataDir)
+
+	for _, tt := range []struct {
+		user     string
+		want     int
+		wantBody string
+	}{
+		{"bob", http.StatusForbidden, "orig"},
+		{"alice", http.StatusOK, "edited"},
+	} {
+		w := serve(server, http.MethodPut, "/api/file?path=pub/n.md", strings.NewReader("edited"), tokens[tt.user])
+		if w.Code != tt.want {
+			t.Errorf("PUT as %s = %d, want %d: %s", tt.user, w.Code, tt.want, w.Body.String())
+		}
+		data, err := os.ReadFile(filepath.Join(dataDir, "real", "n.md"))
+		if err != nil || string(data) != tt.wantBody {
+			t.Errorf("after PUT as %s real/n.md = %q, %v; want %q", tt.user, data, err, tt.wantBody)
+		}
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("pub/n.md is no longer a symlink: %v", err)
+	}
+}
+
+// firstRevision returns the oldest revision of relPath.
+func firstRevision(t *testing.T, relPath string) string {
+	t.Helper()
+	revisions, err := GetHistoryManager().List(relPath)
+	if err != nil || len(revisions) == 0 {
+		t.Fatalf("no revisions of %s: %v", relPath, err)
+	}
+	return revisions[len(revisions)-1].ID
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// NodeMeta is the metadata reported for entries the caller may read;
+// locked nodes leave it out.
+type NodeMeta struct {
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mtime"`
+	Mode       string    `json:"mode"`
+	MimeType   string    `json:"mime,omitempty"`
+	ChildCount *int      `json:"child_count,omitempty"`
+}
+
+// Sort keys accepted by /api/tree and /api/list.
+const (
+	sortByName  = "name"
+	sortBySize  = "size"
+	sortByMtime = "mtime"
+	sortByType  = "type"
+)
+
+// nodeSort is the order of directory entries. Names break ties, so the
+// order is total and can be used as a paging cursor.
+type nodeSort struct {
+	Key       string
+	Desc      bool
+	DirsFirst bool
+}
+
+// parseNodeSort reads the sort, order and dirs_first query parameters.
+// The default is by name, ascending, with files and directories mixed.
+func parseNodeSort(query url.Values) (nodeSort, error) {
+	s := nodeSort{Key: sortByName}
+	if key := query.Get("sort"); key != "" {
+		switch key {
+		case sortByName, sortBySize, sortByMtime, sortByType:
+			s.Key = key
+		default:
+			return s, fmt.Errorf("invalid sort %q", key)
+		}
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		s.Desc = true
+	default:
+		return s, errors.New("invalid order")
+	}
+	switch query.Get("dirs_first") {
+	case "", "false", "0":
+	case "true", "1":
+		s.DirsFirst = true
+	default:
+		return s, errors.New("invalid dirs_first")
+	}
+	return s, nil
+}
+
+func nodeMeta(n Node) NodeMeta {
+	if n.NodeMeta == nil {
+		return NodeMeta{}
+	}
+	return *n.NodeMeta
+}
+
+func (s nodeSort) less(a, b Node) bool {
+	if s.DirsFirst && (a.Type == "dir") != (b.Type == "dir") {
+		return a.Type == "dir"
+	}
+	var c int
+	switch s.Key {
+	case sortBySize:
+		c = cmp.Compare(nodeMeta(a).Size, nodeMeta(b).Size)
+	case sortByMtime:
+		c = nodeMeta(a).ModTime.Compare(nodeMeta(b).ModTime)
+	case sortByType:
+		c = strings.Compare(typeKey(a), typeKey(b))
+	}
+	if c == 0 {
+		switch {
+		case nameLess(a.Name, b.Name):
+			c = -1
+		case nameLess(b.Name, a.Name):
+			c = 1
+		}
+	}
+	if s.Desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+// typeKey groups directories before files and files by extension.
+func typeKey(n Node) string {
+	if n.Type == "dir" {
+		return ""
+	}
+	return "." + strings.ToLower(filepath.Ext(n.Name))
+}
+
+// listCursor holds the sort fields of the last entry of a page.
+type listCursor struct {
+	Name    string `json:"n"`
+	Dir     bool   `json:"d,omitempty"`
+	Size    int64  `json:"s,omitempty"`
+	ModTime int64  `json:"m,omitempty"`
+}
+
+func encodeListCursor(n Node) string {
+	meta := nodeMeta(n)
+	cursor := listCursor{Name: n.Name, Dir: n.Type == "dir", Size: meta.Size}
+	if !meta.ModTime.IsZero() {
+		cursor.ModTime = meta.ModTime.UnixNano()
+	}
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeListCursor returns a stand-in node that sorts where the entry the
+// cursor was made from did, so paging resumes after it even when it has
+// been deleted since.
+func decodeListCursor(value string) (Node, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return Node{}, err
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return Node{}, err
+	}
+	n := Node{Name: cursor.Name, Type: "file", NodeMeta: &NodeMeta{Size: cursor.Size}}
+	if cursor.Dir {
+		n.Type = "dir"
+	}
+	if cursor.ModTime != 0 {
+		n.ModTime = time.Unix(0, cursor.ModTime)
+	}
+	return n, nil
+}
+
+// parseChildCounts reads the counts query parameter. Child counts cost a
+// read of every directory listed, so they are only added on request.
+func parseChildCounts(query url.Values) (bool, error) {
+	switch query.Get("counts") {
+	case "", "false", "0":
+		return false, nil
+	case "true", "1":
+		return true, nil
+	}
+	return false, errors.New("invalid counts")
+}
+
+// entryLink is where a listed entry leads through symlinks, as linkTarget
+// reports it. It is looked up once per entry and shared by every check.
+type entryLink struct {
+	target  string
+	through bool
+}
+
+func resolveEntryLink(baseDir, relPath string) entryLink {
+	target, through := linkTarget(baseDir, relPath)
+	return entryLink{target: target, through: through}
+}
+
+// child returns the link status of the entry name in the directory l
+// describes. Only a symlink needs a lookup of its own; any other entry
+// leads wherever its directory does.
+func (l entryLink) child(baseDir, childRel, name string, isLink bool) entryLink {
+	switch {
+	case isLink:
+		return resolveEntryLink(baseDir, childRel)
+	case l.through:
+		return entryLink{target: path.Join(l.target, name), through: true}
+	}
+	return entryLink{}
+}
+
+// newNode describes the entry at fullPath, which leads to link, for
+// opts.User. Entries the user may not read are returned locked, without
+// metadata.
+func newNode(baseDir, fullPath string, info os.FileInfo, link entryLink, opts TreeOptions) Node {
+	node := Node{
+		Name: info.Name(),
+		Path: toRelative(baseDir, fullPath),
+		Type: "file",
+	}
+	if info.IsDir() {
+		node.Type = "dir"
+	}
+	readable, protected := GetPermissionManager().ReadAccess(opts.User, node.Path, link.target, link.through)
+	node.Protected = protected
+	if !readable {
+		node.Locked = true
+		return node
+	}
+
+	node.NodeMeta = &NodeMeta{
+		ModTime: info.ModTime(),
+		Mode:    fmt.Sprintf("%04o", info.Mode().Perm()),
+	}
+	if info.IsDir() {
+		if opts.ChildCounts {
+			if count, err := countChildren(baseDir, fullPath, link, opts); err == nil {
+				node.ChildCount = &count
+			}
+		}
+	} else {
+		node.Size = info.Size()
+		node.MimeType = detectMimeType(fullPath)
+	}
+	return node
+}
+
+// countChildren returns how many entries a listing of dirPath, which leads
+// to link, would show, without building their nodes.
+func countChildren(baseDir, dirPath string, link entryLink, opts TreeOptions) (int, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	ignore := GetIgnoreManager().ForDir(toRelative(baseDir, dirPath))
+	count := 0
+	for _, entry := range entries {
+		childPath := filepath.Join(dirPath, entry.Name())
+		if childPath == filepath.Join(baseDir, systemDirName) {
+			continue
+		}
+		childRel := toRelative(baseDir, childPath)
+		isLink := entry.Type()&os.ModeSymlink != 0
+		if !opts.ShowHidden {
+			isDir := entry.IsDir()
+			if isLink {
+				info, err := os.Stat(childPath)
+				isDir = err == nil && info.IsDir()
+			}
+			if ignore.ignored(childRel, isDir) {
+				continue
+			}
+		}
+		if opts.ProtectedMode == protectedHide {
+			childLink := link.child(baseDir, childRel, entry.Name(), isLink)
+			if readable, _ := GetPermissionManager().ReadAccess(opts.User, childRel, childLink.target, childLink.through); !readable {
+				continue
+			}
+		}
+		count++
+	}
+	return count, nil
+}
+
+// detectMimeType returns the MIME type for a file name, covering the
+// types the viewer handles that the standard table may not know.
+func detectMimeType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if mimeType := mime.TypeByExtension(ext); mimeType != "" {
+		return mimeType
+	}
+	switch ext {
+	case ".md", ".markdown":
+		return "text/markdown; charset=utf-8"
+	case ".txt":
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
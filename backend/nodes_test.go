@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type listPage struct {
+	Entries    []Node `json:"entries"`
+	NextCursor string `json:"next_cursor"`
+}
+
+func getList(t *testing.T, server http.Handler, query, token string) listPage {
+	t.Helper()
+	w := serve(server, http.MethodGet, "/api/list?"+query, nil, token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/list?%s = %d: %s", query, w.Code, w.Body.String())
+	}
+	var page listPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func TestListPaging(t *testing.T) {
+	dataDir := newTestDataDir(t)
+	for i := 0; i < 7; i++ {
+		writeTestFile(t, dataDir, fmt.Sprintf("d/f%d.txt", i), strings.Repeat("x", 7-i))
+	}
+	writeTestFile(t, dataDir, "d/B/x.txt", "x")
+	writeTestFile(t, dataDir, "d/a/x.txt", "x")
+	// Distinct times so mtime order is well defined: a, B, then f6 down
+	// to f0 from newest to oldest.
+	names := []string{"a", "B", "f6.txt", "f5.txt", "f4.txt", "f3.txt", "f2.txt", "f1.txt", "f0.txt"}
+	for i, name := range names {
+		when := time.Now().Add(-time.Duration(i+1) * time.Minute)
+		if err := os.Chtimes(filepath.Join(dataDir, "d", name), when, when); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := newTestServer(t, dataDir)
+	tokens := newTestUsers(t, nil)
+
+	all := func(query string, deleteAfterFirst string) []string {
+		t.Helper()
+		var names []string
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatalf("%s: paging does not end", query)
+			}
+			page := getList(t, server, query+"&limit=3&cursor="+cursor, tokens["admin"])
+			if len(page.Entries) > 3 {
+				t.Fatalf("%s: page of %d entries", query, len(page.Entries))
+			}
+			for _, entry := range page.Entries {
+				names = append(names, entry.Name)
+			}
+			if pages == 0 && deleteAfterFirst != "" {
+				if err := os.Remove(filepath.Join(dataDir, "d", deleteAfterFirst)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if page.NextCursor == "" {
+				return names
+			}
+			cursor = page.NextCursor
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"path=d", "a,B,f0.txt,f1.txt,f2.txt,f3.txt,f4.txt,f5.txt,f6.txt"},
+		{"path=d&order=desc", "f6.txt,f5.txt,f4.txt,f3.txt,f2.txt,f1.txt,f0.txt,B,a"},
+		{"path=d&sort=size&dirs_first=true", "a,B,f6.txt,f5.txt,f4.txt,f3.txt,f2.txt,f1.txt,f0.txt"},
+		{"path=d&sort=mtime&order=desc", strings.Join(names, ",")},
+		{"path=d&sort=type", "a,B,f0.txt,f1.txt,f2.txt,f3.txt,f4.txt,f5.txt,f6.txt"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(all(tt.query, ""), ","); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	// An entry deleted after it was returned does not shift later pages.
+	if got := strings.Join(all("path=d", "f0.txt"), ","); got != "a,B,f0.txt,f1.txt,f2.txt,f3.txt,f4.txt,f5.txt,f6.txt" {
+		t.Errorf("paging across a delete: %s", got)
+	}
+
+	for _, query := range []string{"path=d&cursor=%25%25", "path=d&limit=0", "path=d&counts=maybe", "path=d/f1.txt"} {
+		if w := serve(server, http.MethodGet, "/api/list?"+query, nil, tokens["admin"]); w.Code != http.StatusBadRequest {
+			t.Errorf("GET /api/list?%s = %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestListChildCounts(t *testing.T) {
+	dataDir := newTestDataDir(t, "/d/private")
+	writeTestFile(t, dataDir, "d/sub/a.md", "a")
+	writeTestFile(t, dataDir, "d/sub/b.md", "b")
+	writeTestFile(t, dataDir, "d/sub/x.swp", "")
+	writeTestFile(t, dataDir, "d/private/p.md", "p")
+	server := newTestServer(t, dataDir)
+	tokens := newTestUsers(t, nil)
+
+	counts := func(query string) map[string]int {
+		t.Helper()
+		out := make(map[string]int)
+		for _, entry := range getList(t, server, query, tokens["admin"]).Entries {
+			if entry.NodeMeta != nil && entry.ChildCount != nil {
+				out[entry.Name] = *entry.ChildCount
+			}
+		}
+		return out
+	}
+	if got := counts("path=d"); len(got) != 0 {
+		t.Errorf("child counts without counts=true: %v", got)
+	}
+	if got := counts("path=d&counts=true"); got["sub"] != 2 || got["private"] != 1 {
+		t.Errorf("child counts = %v, want sub 2, private 1", got)
+	}
+	if got := counts("path=d&counts=true&hidden=true"); got["sub"] != 3 {
+		t.Errorf("child counts with hidden entries = %v, want sub 3", got)
+	}
+}
+
+func TestListThroughSymlink(t *testing.T) {
+	dataDir := newTestDataDir(t, "/real")
+	writeTestFile(t, dataDir, "real/a.md", "a")
+	writeTestFile(t, dataDir, "pub/b.md", "b")
+	mustSymlink(t, "../real", filepath.Join(dataDir, "pub", "link"))
+	mustSymlink(t, "../real/a.md", filepath.Join(dataDir, "pub", "a.md"))
+	server := newTestServer(t, dataDir)
+	tokens := newTestUsers(t, nil)
+
+	byName := func(page listPage) map[string]Node {
+		nodes := make(map[string]Node)
+		for _, entry := range page.Entries {
+			nodes[entry.Name] = entry
+		}
+		return nodes
+	}
+	for _, token := range []string{"", tokens["admin"]} {
+		admin := token != ""
+		nodes := byName(getList(t, server, "path=pub", token))
+		for _, name := range []string{"link", "a.md"} {
+			node := nodes[name]
+			if !node.Symlink || !node.Protected || node.Locked == admin {
+				t.Errorf("pub/%s as admin=%v: %+v, want a protected symlink, locked unless admin", name, admin, node)
+			}
+		}
+		if node := nodes["b.md"]; node.Protected || node.Locked {
+			t.Errorf("pub/b.md as admin=%v: %+v", admin, node)
+		}
+	}
+
+	// Entries of a symlinked directory take their protection from the
+	// target.
+	nodes := byName(getList(t, server, "path=pub/link", tokens["admin"]))
+	if node := nodes["a.md"]; !node.Protected || node.Locked || node.NodeMeta == nil {
+		t.Errorf("pub/link/a.md as admin: %+v", node)
+	}
+}
@@ -3,26 +3,57 @@ package main
 import (
 	"fmt"
 	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
+const permissionWatchInterval = 2 * time.Second
+
+// permissionLine is one line of .permissions. Comments and blank lines are
+// kept verbatim so that saving the file does not lose them; rule lines also
+// keep their original text until the rule is changed.
+type permissionLine struct {
+	raw   string
+	entry *ACLEntry
+}
+
+func (l permissionLine) String() string {
+	if l.entry != nil && l.raw == "" {
+		return l.entry.String()
+	}
+	return l.raw
+}
+
 type PermissionManager struct {
-	mu            sync.RWMutex
-	permissionMap map[string]bool
-	filePath      string
+	mu       sync.RWMutex
+	lines    []permissionLine
+	entries  []ACLEntry
+	filePath string
+	dataDir  string
+	modTime  time.Time
+	size     int64
+	watcher  *backgroundJob
 }
 
 var globalPermissionManager *PermissionManager
 
-func InitPermissionManager(dataDir string) error {
+// InitPermissionManager reads .permissions from userDir. Rules apply to
+// paths below dataDir; an empty dataDir skips the symlink target check.
+func InitPermissionManager(userDir, dataDir string) error {
 	pm := &PermissionManager{
-		permissionMap: make(map[string]bool),
-		filePath:      filepath.Join(dataDir, ".permissions"),
+		filePath: filepath.Join(userDir, ".permissions"),
+		dataDir:  dataDir,
 	}
 
 	if err := pm.load(); err != nil {
@@ -30,18 +61,21 @@ func InitPermissionManager(dataDir string) error {
 	}
 
 	globalPermissionManager = pm
+	pm.watcher = startJob(permissionWatchInterval, false, pm.reloadIfModified)
 	return nil
 }
 
+// Close stops watching .permissions.
+func (pm *PermissionManager) Close() {
+	pm.watcher.Stop()
+}
+
 func GetPermissionManager() *PermissionManager {
 	return globalPermissionManager
 }
 
 func (pm *PermissionManager) load() error {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-
-	file, err := os.Open(pm.filePath)
+	lines, info, err := readPermissionFile(pm.filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			fmt.Printf("Permission file not found: %s\n", pm.filePath)
@@ -49,103 +83,310 @@ func (pm *PermissionManager) load() error {
 		}
 		return err
 	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.setLines(lines)
+	pm.modTime, pm.size = info.ModTime(), info.Size()
+	for _, entry := range pm.entries {
+		fmt.Printf("Loaded permission: %s\n", entry)
+	}
+	fmt.Printf("Total permissions loaded: %d\n", len(pm.entries))
+	return nil
+}
+
+// readPermissionFile parses the whole file before anything is swapped in,
+// so a broken edit never leaves the manager with partial rules.
+func readPermissionFile(filePath string) ([]permissionLine, os.FileInfo, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer file.Close()
 
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var lines []permissionLine
 	scanner := bufio.NewScanner(file)
+	lineNo := 0
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+		lineNo++
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
 		if line == "" || strings.HasPrefix(line, "#") {
+			lines = append(lines, permissionLine{raw: raw})
 			continue
 		}
-		pm.permissionMap[line] = true
-		fmt.Printf("Loaded permission: %s\n", line)
+		entry, err := parseACLLine(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %w", filePath, lineNo, err)
+		}
+		lines = append(lines, permissionLine{raw: raw, entry: &entry})
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return lines, info, nil
+}
 
-	fmt.Printf("Total permissions loaded: %d\n", len(pm.permissionMap))
-	return scanner.Err()
+// setLines installs lines and rebuilds the rule list in file order. Callers
+// must hold pm.mu.
+func (pm *PermissionManager) setLines(lines []permissionLine) {
+	entries := make([]ACLEntry, 0, len(lines))
+	for _, line := range lines {
+		if line.entry != nil {
+			entries = append(entries, *line.entry)
+		}
+	}
+	pm.lines = lines
+	pm.entries = entries
 }
 
-func (pm *PermissionManager) save() error {
-	file, err := os.Create(pm.filePath)
+// reloadIfModified is polled to pick up edits to .permissions made outside
+// the API, e.g. by hand or by deploy tooling. If the new contents fail to
+// parse the current rules stay in force.
+func (pm *PermissionManager) reloadIfModified() {
+	info, err := os.Stat(pm.filePath)
 	if err != nil {
-		return err
+		return
 	}
-	defer file.Close()
 
-	for path := range pm.permissionMap {
-		if _, err := file.WriteString(path + "\n"); err != nil {
-			return err
+	pm.mu.RLock()
+	unchanged := info.ModTime().Equal(pm.modTime) && info.Size() == pm.size
+	pm.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	lines, info, err := readPermissionFile(pm.filePath)
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if err != nil {
+		fmt.Printf("Permission file reload failed, keeping previous rules: %v\n", err)
+		// Remember the broken version so the error is logged once, not on
+		// every poll.
+		if info, statErr := os.Stat(pm.filePath); statErr == nil {
+			pm.modTime, pm.size = info.ModTime(), info.Size()
 		}
+		return
 	}
+	pm.setLines(lines)
+	pm.modTime, pm.size = info.ModTime(), info.Size()
+	fmt.Printf("Permission file reloaded, %d permissions loaded\n", len(pm.entries))
+}
 
+// save writes the file back in its original order and installs lines only
+// once the write succeeded. Callers must hold pm.mu.
+func (pm *PermissionManager) save(lines []permissionLine) error {
+	var sb strings.Builder
+	for _, line := range lines {
+		sb.WriteString(line.String())
+		sb.WriteByte('\n')
+	}
+	if err := writeFileAtomic(pm.filePath, []byte(sb.String()), 0o644); err != nil {
+		return err
+	}
+	pm.setLines(lines)
+
+	// Our own writes are not external edits; don't reload them.
+	if info, err := os.Stat(pm.filePath); err == nil {
+		pm.modTime, pm.size = info.ModTime(), info.Size()
+	}
 	return nil
 }
 
-func (pm *PermissionManager) AddPermission(path string) error {
+// AddPermission stores entry. An existing rule for the same pattern and
+// subject is updated in place; new rules are appended to the end of the
+// file. Entries come from newACLEntry.
+func (pm *PermissionManager) AddPermission(entry ACLEntry) error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	pm.permissionMap[path] = true
-	return pm.save()
+	lines := make([]permissionLine, len(pm.lines), len(pm.lines)+1)
+	copy(lines, pm.lines)
+	for i, line := range lines {
+		if line.entry != nil && line.entry.samePathAndSubject(entry) {
+			lines[i] = permissionLine{entry: &entry}
+			return pm.save(lines)
+		}
+	}
+	lines = append(lines, permissionLine{entry: &entry})
+	return pm.save(lines)
 }
 
-func (pm *PermissionManager) RemovePermission(path string) error {
+// RemovePermission deletes the rule with entry's pattern and subject.
+func (pm *PermissionManager) RemovePermission(entry ACLEntry) error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	delete(pm.permissionMap, path)
-	return pm.save()
+	return pm.save(pm.filterLines(func(e ACLEntry) bool {
+		return !e.samePathAndSubject(entry)
+	}))
 }
 
-func (pm *PermissionManager) HasPermission(path string) bool {
+// RenamePath makes rules that name oldRel, or anything below it, follow the
+// path to newRel so protection survives a move. Anchored rules are
+// rewritten in place. Unanchored rules may cover other paths too, so they
+// are kept and, unless they still match the new location, an anchored
+// copy for it is appended.
+func (pm *PermissionManager) RenamePath(oldRel, newRel string) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	lines := make([]permissionLine, len(pm.lines))
+	copy(lines, pm.lines)
+	changed := false
+	for i, line := range lines {
+		if line.entry == nil {
+			continue
+		}
+		entry, ok := line.entry.renamed(oldRel, newRel)
+		if !ok {
+			continue
+		}
+		if line.entry.anchored() {
+			lines[i] = permissionLine{entry: &entry}
+		} else if _, still := line.entry.match(normalizeACLPath(entry.Path)); !still {
+			lines = append(lines, permissionLine{entry: &entry})
+		} else {
+			continue
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return pm.save(lines)
+}
+
+// PinnedRule returns a glob or regex rule covering one of paths below
+// oldRel that would no longer cover it below newRel. RenamePath cannot
+// rewrite such rules, so moving the paths would strip the protection the
+// rule gives them. paths are relative to oldRel, as subtreePaths lists
+// them.
+func (pm *PermissionManager) PinnedRule(oldRel, newRel string, paths []string) (ACLEntry, bool) {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
 
-	fmt.Printf("HasPermission called: path=%s\n", path)
-	fmt.Printf("Loaded permissions: %v\n", pm.permissionMap)
+	for _, entry := range pm.entries {
+		if entry.Negate || entry.literal() {
+			continue
+		}
+		for _, p := range paths {
+			_, before := entry.match(path.Join(oldRel, p))
+			_, after := entry.match(path.Join(newRel, p))
+			if before && !after {
+				return entry, true
+			}
+		}
+	}
+	return ACLEntry{}, false
+}
 
-	if pm.permissionMap[path] {
-		fmt.Printf("HasPermission exact match: path=%s, result=true\n", path)
-		return true
+// filterLines returns a copy of the file's lines without the rules for
+// which keep returns false. Callers must hold pm.mu.
+func (pm *PermissionManager) filterLines(keep func(ACLEntry) bool) []permissionLine {
+	lines := make([]permissionLine, 0, len(pm.lines))
+	for _, line := range pm.lines {
+		if line.entry == nil || keep(*line.entry) {
+			lines = append(lines, line)
+		}
 	}
+	return lines
+}
 
-	parts := strings.Split(path, "/")
-	for i := 0; i < len(parts); i++ {
-		for j := i + 1; j <= len(parts); j++ {
-			subpath := strings.Join(parts[i:j], "/")
-			if pm.permissionMap[subpath] {
-				fmt.Printf("HasPermission subpath match: path=%s, subpath=%s, result=true\n", path, subpath)
-				return true
-			}
+// Check reports whether user (nil for anonymous callers) may perform action
+// on relPath. Admins may do anything; everyone else is limited by their
+// role first and by the ACL entries second.
+func (pm *PermissionManager) Check(user *User, relPath string, action Action) bool {
+	return pm.decide(user, relPath, action).Allowed
+}
+
+// decide evaluates the ACL even when the role settles the outcome, so that
+// Explain can still show the matching rule. A path that goes through a
+// symlink must also pass the rules of the place the link leads to, or a
+// link in an open directory would expose a closed one.
+func (pm *PermissionManager) decide(user *User, relPath string, action Action) aclDecision {
+	linked, throughLink := linkTarget(pm.dataDir, relPath)
+	return pm.decideLinked(user, relPath, linked, throughLink, action)
+}
+
+// decideLinked is decide for a path whose symlink target the caller has
+// already looked up with linkTarget.
+func (pm *PermissionManager) decideLinked(user *User, relPath, linked string, throughLink bool, action Action) aclDecision {
+	pm.mu.RLock()
+	decision := checkACL(pm.entries, user, relPath, action)
+	if throughLink && decision.Allowed {
+		if target := checkACL(pm.entries, user, linked, action); !target.Allowed {
+			decision = target
+			decision.Reason = "symlink target: " + target.Reason
 		}
 	}
+	pm.mu.RUnlock()
 
-	fmt.Printf("HasPermission: path=%s, result=false\n", path)
-	return false
+	switch {
+	case user != nil && user.Role.Allows(RoleAdmin):
+		decision.Allowed, decision.Reason = true, "admin role"
+	case roleCeiling(user)&action == 0:
+		decision.Allowed, decision.Reason = false, "role"
+	}
+	return decision
 }
 
-func (pm *PermissionManager) ListPermissions() []string {
+// Explain reports, per action, whether user may act on relPath and which
+// rule made the decision.
+func (pm *PermissionManager) Explain(user *User, relPath string) map[string]aclDecision {
+	decisions := make(map[string]aclDecision, len(actionLetters))
+	for _, al := range actionLetters {
+		decisions[al.action.Name()] = pm.decide(user, relPath, al.action)
+	}
+	return decisions
+}
+
+// IsProtected reports whether relPath is hidden from anonymous callers.
+func (pm *PermissionManager) IsProtected(relPath string) bool {
+	return !pm.Check(nil, relPath, ActionRead)
+}
+
+// ReadAccess reports what Check for reading and IsProtected would for
+// relPath, whose symlink target the caller has already looked up with
+// linkTarget. Listings use it to resolve every entry only once.
+func (pm *PermissionManager) ReadAccess(user *User, relPath, linked string, throughLink bool) (readable, protected bool) {
+	protected = !pm.decideLinked(nil, relPath, linked, throughLink, ActionRead).Allowed
+	if user == nil {
+		return !protected, protected
+	}
+	return pm.decideLinked(user, relPath, linked, throughLink, ActionRead).Allowed, protected
+}
+
+func (pm *PermissionManager) ListPermissions() []ACLEntry {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
 
-	paths := make([]string, 0, len(pm.permissionMap))
-	for path := range pm.permissionMap {
-		paths = append(paths, path)
-	}
-	return paths
+	entries := make([]ACLEntry, len(pm.entries))
+	copy(entries, pm.entries)
+	return entries
 }
 
+// ClearAll removes every rule but keeps the file's comments.
 func (pm *PermissionManager) ClearAll() error {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	pm.permissionMap = make(map[string]bool)
-	return pm.save()
+	return pm.save(pm.filterLines(func(ACLEntry) bool { return false }))
 }
 
 type User struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Role     Role     `json:"role"`
+	Groups   []string `json:"groups,omitempty"`
 }
 
 type UserManager struct {
@@ -168,7 +409,11 @@ func InitUserManager(dataDir string) error {
 	}
 
 	if len(um.users) == 0 {
-		um.users["admin"] = User{Username: "admin", Password: "admin"}
+		hash, err := hashPassword("admin")
+		if err != nil {
+			return err
+		}
+		um.users["admin"] = User{Username: "admin", Password: hash, Role: RoleAdmin}
 		um.save()
 	}
 
@@ -208,31 +453,81 @@ func (um *UserManager) load() error {
 		um.users[user.Username] = user
 	}
 
-	return nil
+	return um.migrateUsers()
 }
 
-func (um *UserManager) save() error {
-	file, err := os.Create(um.filePath)
-	if err != nil {
-		return err
+// migrateUsers upgrades entries written before passwords were hashed or
+// roles existed, and writes the file back if anything changed. Users
+// without a role become viewers rather than keep the full access they had
+// before role checks; an admin has to grant more on purpose. Callers must
+// hold um.mu.
+func (um *UserManager) migrateUsers() error {
+	migrated := 0
+	for username, user := range um.users {
+		changed := false
+		if !isPasswordHash(user.Password) {
+			hash, err := hashPassword(user.Password)
+			if err != nil {
+				return err
+			}
+			user.Password = hash
+			changed = true
+		}
+		if user.Role == "" {
+			user.Role = RoleViewer
+			changed = true
+			fmt.Printf("WARNING: user %s had no role and is now a viewer; grant more with tools --change --username %s --role editor|admin\n", username, username)
+		} else if !user.Role.Valid() {
+			fmt.Printf("User %s has unknown role %q and will be denied access\n", username, user.Role)
+		}
+		if changed {
+			um.users[username] = user
+			migrated++
+		}
 	}
-	defer file.Close()
+	if migrated == 0 {
+		return nil
+	}
+	fmt.Printf("Migrated %d user entr(ies) to hashed passwords and roles\n", migrated)
+	return um.save()
+}
 
+func (um *UserManager) save() error {
 	users := make([]User, 0, len(um.users))
 	for _, user := range um.users {
 		users = append(users, user)
 	}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(users)
+	err := writeAtomic(um.filePath, 0o644, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(users)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Track our own writes so checkFileModified does not mistake them for
+	// an external edit and drop every session.
+	if info, err := os.Stat(um.filePath); err == nil {
+		um.modTime = info.ModTime()
+	}
+	return nil
 }
 
-func (um *UserManager) AddUser(username, password string) error {
+func (um *UserManager) AddUser(username, password string, role Role) error {
+	if !role.Valid() {
+		return fmt.Errorf("invalid role %q", role)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
-	um.users[username] = User{Username: username, Password: password}
+	um.users[username] = User{Username: username, Password: hash, Role: role}
 	return um.save()
 }
 
@@ -256,9 +551,12 @@ func (um *UserManager) Authenticate(username, password string) bool {
 
 	user, exists := um.users[username]
 	if !exists {
+		// Compare against a dummy hash so unknown usernames take as long
+		// as wrong passwords.
+		verifyPassword(dummyPasswordHash, password)
 		return false
 	}
-	return user.Password == password
+	return verifyPassword(user.Password, password)
 }
 
 func (um *UserManager) checkFileModified() error {
@@ -288,6 +586,9 @@ func (um *UserManager) checkFileModified() error {
 		for _, user := range users {
 			um.users[user.Username] = user
 		}
+		if err := um.migrateUsers(); err != nil {
+			return err
+		}
 		
 		fmt.Printf("User file reloaded successfully, %d users loaded\n", len(um.users))
 		return fmt.Errorf("user file has been modified")
@@ -295,6 +596,14 @@ func (um *UserManager) checkFileModified() error {
 	return nil
 }
 
+func (um *UserManager) GetUser(username string) (User, bool) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+
+	user, exists := um.users[username]
+	return user, exists
+}
+
 func (um *UserManager) ListUsers() []User {
 	um.mu.RLock()
 	defer um.mu.RUnlock()
@@ -306,57 +615,160 @@ func (um *UserManager) ListUsers() []User {
 	return users
 }
 
+// Passwords are stored in bcrypt's modular crypt format ("$2a$<cost>$..."),
+// which carries its own algorithm version and cost so stronger settings can
+// be introduced later without breaking existing entries.
+const passwordHashCost = bcrypt.DefaultCost
+
+var dummyPasswordHash, _ = hashPassword("filemanager-dummy-password")
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func isPasswordHash(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
+
+// verifyPassword reports whether password matches the stored hash. The
+// comparison is constant-time; plaintext entries never match.
+func verifyPassword(stored, password string) bool {
+	if !isPasswordHash(stored) {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+}
+
+const (
+	sessionIdleTimeout    = 30 * time.Minute
+	sessionMaxLifetime    = 24 * time.Hour
+	sessionSweepInterval  = time.Minute
+	sessionTouchInterval  = time.Minute
+	sessionTokenByteCount = 32
+)
+
+// Session is keyed by the SHA-256 of its token; the raw token is only ever
+// handed to the client and never kept by the server.
 type Session struct {
-	Token        string
-	Username     string
-	LastActivity time.Time
+	TokenHash    string    `json:"token_hash"`
+	Username     string    `json:"username"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+func (s Session) expired(now time.Time) bool {
+	return now.Sub(s.LastActivity) > sessionIdleTimeout || now.Sub(s.CreatedAt) > sessionMaxLifetime
 }
 
 type SessionManager struct {
-	mu       sync.RWMutex
-	sessions map[string]Session
+	store SessionStore
+	sweep *backgroundJob
 }
 
 var globalSessionManager *SessionManager
 
-func InitSessionManager() {
+func InitSessionManager(store SessionStore) {
 	globalSessionManager = &SessionManager{
-		sessions: make(map[string]Session),
+		store: store,
 	}
+	globalSessionManager.sweepExpired()
+	globalSessionManager.sweep = startJob(sessionSweepInterval, false, globalSessionManager.sweepExpired)
 }
 
 func GetSessionManager() *SessionManager {
 	return globalSessionManager
 }
 
-func (sm *SessionManager) CreateSession(username string) string {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+func newSessionToken() (string, error) {
+	buf := make([]byte, sessionTokenByteCount)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession issues a fresh opaque token for username. Every login gets
+// its own token, so one user can be signed in on several devices at once.
+func (sm *SessionManager) CreateSession(username string) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
 
-	token := username
-	sm.sessions[token] = Session{
-		Token:        token,
+	now := time.Now()
+	session := Session{
+		TokenHash:    hashSessionToken(token),
 		Username:     username,
-		LastActivity: time.Now(),
+		CreatedAt:    now,
+		LastActivity: now,
+	}
+	if err := sm.store.Put(session); err != nil {
+		return "", err
 	}
-	return token
+	return token, nil
 }
 
-func (sm *SessionManager) ValidateAndTouch(token string) bool {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-
-	session, exists := sm.sessions[token]
+// ValidateAndTouch returns the live session for token and refreshes its
+// idle timer. The refresh is only written back once per
+// sessionTouchInterval so persistent stores are not rewritten per request.
+func (sm *SessionManager) ValidateAndTouch(token string) (Session, bool) {
+	key := hashSessionToken(token)
+	session, exists, err := sm.store.Get(key)
+	if err != nil {
+		fmt.Printf("Session lookup failed: %v\n", err)
+		return Session{}, false
+	}
 	if !exists {
-		return false
+		return Session{}, false
+	}
+	now := time.Now()
+	if session.expired(now) {
+		if err := sm.store.Delete(key); err != nil {
+			fmt.Printf("Failed to delete expired session: %v\n", err)
+		}
+		return Session{}, false
+	}
+	if now.Sub(session.LastActivity) >= sessionTouchInterval {
+		session.LastActivity = now
+		if err := sm.store.Put(session); err != nil {
+			fmt.Printf("Failed to refresh session: %v\n", err)
+		}
+	}
+	return session, true
+}
+
+func (sm *SessionManager) DeleteSession(token string) {
+	if err := sm.store.Delete(hashSessionToken(token)); err != nil {
+		fmt.Printf("Failed to delete session: %v\n", err)
 	}
-	session.LastActivity = time.Now()
-	sm.sessions[token] = session
-	return true
 }
 
 func (sm *SessionManager) ClearAllSessions() {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
-	sm.sessions = make(map[string]Session)
+	err := sm.store.DeleteWhere(func(Session) bool { return true })
+	if err != nil {
+		fmt.Printf("Failed to clear sessions: %v\n", err)
+	}
+}
+
+func (sm *SessionManager) sweepExpired() {
+	now := time.Now()
+	err := sm.store.DeleteWhere(func(s Session) bool { return s.expired(now) })
+	if err != nil {
+		fmt.Printf("Failed to sweep expired sessions: %v\n", err)
+	}
+}
+
+// Close stops the job sweeping out expired sessions.
+func (sm *SessionManager) Close() {
+	sm.sweep.Stop()
 }
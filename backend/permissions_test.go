@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestPermissionManager installs a permission manager for dataDir
+// reading rules from a fresh .permissions file.
+func newTestPermissionManager(t *testing.T, dataDir string, rules ...string) *PermissionManager {
+	t.Helper()
+	dir := t.TempDir()
+	content := strings.Join(rules, "\n") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, ".permissions"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitPermissionManager(dir, dataDir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(GetPermissionManager().Close)
+	return GetPermissionManager()
+}
+
+func TestRenamePathKeepsProtection(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     []string
+		oldRel    string
+		newRel    string
+		protected []string
+		open      []string
+	}{
+		{
+			name:      "anchored rule follows the move",
+			rules:     []string{"/notes/pic"},
+			oldRel:    "notes/pic",
+			newRel:    "notes/photos",
+			protected: []string{"notes/photos", "notes/photos/a.png"},
+			open:      []string{"notes/pic"},
+		},
+		{
+			name:      "unanchored rule matching inside the moved path",
+			rules:     []string{"pic"},
+			oldRel:    "notes/pic",
+			newRel:    "notes/photos",
+			protected: []string{"notes/photos", "notes/photos/a.png", "other/pic"},
+		},
+		{
+			name:      "unanchored rule covering an ancestor",
+			rules:     []string{"notes"},
+			oldRel:    "notes/pic",
+			newRel:    "archive/pic",
+			protected: []string{"archive/pic/a.png", "notes/other"},
+			open:      []string{"archive/other"},
+		},
+		{
+			name:      "unanchored rule below the moved path",
+			rules:     []string{"pic/secret"},
+			oldRel:    "notes/pic",
+			newRel:    "notes/photos",
+			protected: []string{"notes/photos/secret/a.png", "other/pic/secret"},
+			open:      []string{"notes/photos/public"},
+		},
+		{
+			name:      "unanchored rule still covering the new location",
+			rules:     []string{"pic"},
+			oldRel:    "a/pic",
+			newRel:    "b/pic",
+			protected: []string{"b/pic"},
+		},
+		{
+			name:   "unrelated unanchored rule",
+			rules:  []string{"secret"},
+			oldRel: "notes/pic",
+			newRel: "notes/photos",
+			open:   []string{"notes/photos"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm := newTestPermissionManager(t, "", tt.rules...)
+			if err := pm.RenamePath(tt.oldRel, tt.newRel); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range tt.protected {
+				if !pm.IsProtected(p) {
+					t.Errorf("IsProtected(%q) = false, want true; rules %v", p, pm.ListPermissions())
+				}
+			}
+			for _, p := range tt.open {
+				if pm.IsProtected(p) {
+					t.Errorf("IsProtected(%q) = true, want false; rules %v", p, pm.ListPermissions())
+				}
+			}
+		})
+	}
+}
+
+func TestReloadKeepsRulesOnParseError(t *testing.T) {
+	pm := newTestPermissionManager(t, "", "/private user:alice r")
+	rules := func() []string {
+		var out []string
+		for _, entry := range pm.ListPermissions() {
+			out = append(out, entry.String())
+		}
+		return out
+	}
+
+	if err := os.WriteFile(pm.filePath, []byte("/public user:bob rw\n/broken user:bob rz\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pm.reloadIfModified()
+	if got := rules(); len(got) != 1 || got[0] != "/private user:alice r" {
+		t.Fatalf("rules after a broken edit = %v, want the previous rules", got)
+	}
+
+	if err := os.WriteFile(pm.filePath, []byte("/public user:bob rw\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pm.reloadIfModified()
+	if got := rules(); len(got) != 1 || got[0] != "/public user:bob rw" {
+		t.Fatalf("rules after fixing the edit = %v, want [/public user:bob rw]", got)
+	}
+}
+
+func TestSaveKeepsCommentsAndOrder(t *testing.T) {
+	pm := newTestPermissionManager(t, "",
+		"# Shared notes",
+		"/notes user:alice r",
+		"",
+		"#  team space, indented rule kept verbatim",
+		"  /team group:ops rwd",
+		"pic",
+	)
+	alice, err := newACLEntry("/notes", "user:alice", ActionRead|ActionWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.AddPermission(alice); err != nil {
+		t.Fatal(err)
+	}
+	added, err := newACLEntry("/archive", "authenticated", ActionRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.AddPermission(added); err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := newACLEntry("pic", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.RemovePermission(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(pm.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"# Shared notes",
+		"/notes user:alice rw",
+		"",
+		"#  team space, indented rule kept verbatim",
+		"  /team group:ops rwd",
+		"/archive authenticated r",
+	}, "\n") + "\n"
+	if string(data) != want {
+		t.Errorf("saved file:\n%s\nwant:\n%s", data, want)
+	}
+
+	// The saved file reads back to the same rules.
+	if err := InitPermissionManager(filepath.Dir(pm.filePath), ""); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := GetPermissionManager()
+	reloaded.Close()
+	if got, want := reloaded.ListPermissions(), pm.ListPermissions(); len(got) != len(want) {
+		t.Fatalf("reloaded %v, want %v", got, want)
+	} else {
+		for i := range got {
+			if got[i].String() != want[i].String() {
+				t.Errorf("reloaded rule %d = %s, want %s", i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestUserPasswordMigration(t *testing.T) {
+	dir := t.TempDir()
+	userFile := filepath.Join(dir, "user.json")
+	legacy := `[{"username": "bob", "password": "hunter2", "role": "editor"}]`
+	if err := os.WriteFile(userFile, []byte(legacy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	InitSessionManager(newMemorySessionStore())
+	t.Cleanup(GetSessionManager().Close)
+	if err := InitUserManager(dir); err != nil {
+		t.Fatal(err)
+	}
+	um := GetUserManager()
+
+	user, ok := um.GetUser("bob")
+	if !ok {
+		t.Fatal("bob is missing after migration")
+	}
+	if cost, err := bcrypt.Cost([]byte(user.Password)); err != nil || cost != passwordHashCost {
+		t.Errorf("migrated password %q: cost %d, %v; want a bcrypt hash of cost %d", user.Password, cost, err, passwordHashCost)
+	}
+	data, err := os.ReadFile(userFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Errorf("user.json still holds the plaintext password:\n%s", data)
+	}
+	if !um.Authenticate("bob", "hunter2") {
+		t.Error("the old password no longer works after migration")
+	}
+	if um.Authenticate("bob", "hunter3") {
+		t.Error("a wrong password was accepted")
+	}
+	if verifyPassword("hunter2", "hunter2") {
+		t.Error("a plaintext entry matched its own text")
+	}
+}
+
+func TestUserRoleMigration(t *testing.T) {
+	dir := t.TempDir()
+	userFile := filepath.Join(dir, "user.json")
+	legacy := `[{"username": "carol", "password": "hunter2"}, {"username": "root", "password": "toor", "role": "admin"}]`
+	if err := os.WriteFile(userFile, []byte(legacy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitUserManager(dir); err != nil {
+		t.Fatal(err)
+	}
+	um := GetUserManager()
+
+	for username, want := range map[string]Role{"carol": RoleViewer, "root": RoleAdmin} {
+		user, ok := um.GetUser(username)
+		if !ok {
+			t.Fatalf("%s is missing after migration", username)
+		}
+		if user.Role != want {
+			t.Errorf("%s: role = %q, want %q", username, user.Role, want)
+		}
+	}
+	var saved []User
+	data, err := os.ReadFile(userFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range saved {
+		if user.Username == "carol" && user.Role != RoleViewer {
+			t.Errorf("user.json keeps carol as %q, want %q", user.Role, RoleViewer)
+		}
+	}
+}
+
+func TestUnknownUserComparesDummyHash(t *testing.T) {
+	if cost, err := bcrypt.Cost([]byte(dummyPasswordHash)); err != nil || cost != passwordHashCost {
+		t.Fatalf("dummyPasswordHash: cost %d, %v; want a bcrypt hash of cost %d", cost, err, passwordHashCost)
+	}
+
+	newTestUsers(t, map[string]Role{"bob": RoleEditor})
+	um := GetUserManager()
+	timeLogin := func(username string) time.Duration {
+		start := time.Now()
+		if um.Authenticate(username, "wrong") {
+			t.Fatalf("%s logged in with a wrong password", username)
+		}
+		return time.Since(start)
+	}
+	// A bcrypt comparison dominates either path, so an unknown user
+	// must cost about as much as a wrong password; the bound is loose
+	// to stay clear of scheduling noise.
+	known, unknown := timeLogin("bob"), timeLogin("nobody")
+	if unknown < known/4 {
+		t.Errorf("unknown user took %v, wrong password %v", unknown, known)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name         string
+		created      time.Duration
+		lastActivity time.Duration
+		expired      bool
+	}{
+		{"fresh", 0, 0, false},
+		{"idle just under the limit", time.Hour, sessionIdleTimeout - time.Second, false},
+		{"idle past the limit", time.Hour, sessionIdleTimeout + time.Second, true},
+		{"active near the lifetime", sessionMaxLifetime - time.Second, time.Second, false},
+		{"active past the lifetime", sessionMaxLifetime + time.Second, time.Second, true},
+	}
+	for _, tt := range tests {
+		session := Session{CreatedAt: now.Add(-tt.created), LastActivity: now.Add(-tt.lastActivity)}
+		if got := session.expired(now); got != tt.expired {
+			t.Errorf("%s: expired = %v, want %v", tt.name, got, tt.expired)
+		}
+	}
+}
+
+func TestSessionManager(t *testing.T) {
+	store := newMemorySessionStore()
+	InitSessionManager(store)
+	t.Cleanup(GetSessionManager().Close)
+	sm := GetSessionManager()
+
+	token, err := sm.CreateSession("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := sm.CreateSession("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == other || len(token) != 2*sessionTokenByteCount {
+		t.Fatalf("tokens %q and %q: want two distinct %d-byte hex tokens", token, other, sessionTokenByteCount)
+	}
+
+	// Only the SHA-256 of a token is kept.
+	for key, session := range store.sessions {
+		if key == token || key == other || session.TokenHash != key {
+			t.Errorf("session %+v stored under %q", session, key)
+		}
+	}
+	if _, ok := store.sessions[hashSessionToken(token)]; !ok {
+		t.Error("no session stored under the token's hash")
+	}
+
+	if session, ok := sm.ValidateAndTouch(token); !ok || session.Username != "bob" {
+		t.Fatalf("ValidateAndTouch = %+v, %v", session, ok)
+	}
+	if _, ok := sm.ValidateAndTouch(hashSessionToken(token)); ok {
+		t.Error("the stored hash was accepted as a token")
+	}
+
+	// A request refreshes the idle timer once it is a touch interval old.
+	key := hashSessionToken(token)
+	stale := store.sessions[key]
+	stale.LastActivity = time.Now().Add(-sessionIdleTimeout + time.Minute)
+	store.Put(stale)
+	if _, ok := sm.ValidateAndTouch(token); !ok {
+		t.Fatal("session expired before the idle timeout")
+	}
+	if touched := store.sessions[key].LastActivity; time.Since(touched) > time.Minute {
+		t.Errorf("LastActivity = %v, want it refreshed", touched)
+	}
+
+	// Idle sessions are refused and dropped.
+	stale = store.sessions[key]
+	stale.LastActivity = time.Now().Add(-sessionIdleTimeout - time.Minute)
+	store.Put(stale)
+	if _, ok := sm.ValidateAndTouch(token); ok {
+		t.Error("idle session was accepted")
+	}
+	if _, ok := store.sessions[key]; ok {
+		t.Error("idle session was kept")
+	}
+
+	// The sweeper drops sessions past their lifetime without a request.
+	otherKey := hashSessionToken(other)
+	old := store.sessions[otherKey]
+	old.CreatedAt = time.Now().Add(-sessionMaxLifetime - time.Minute)
+	store.Put(old)
+	sm.sweepExpired()
+	if _, ok := store.sessions[otherKey]; ok {
+		t.Error("expired session survived the sweep")
+	}
+
+	logout, err := sm.CreateSession("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.DeleteSession(logout)
+	if _, ok := sm.ValidateAndTouch(logout); ok {
+		t.Error("session is valid after logout")
+	}
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	searchMaxFileSize    = 8 << 20
+	searchRescanInterval = 10 * time.Minute
+	defaultSearchLimit   = 20
+	maxSearchLimit       = 100
+	searchSnippetLead    = 40
+	searchSnippetLength  = 160
+)
+
+// searchableExtensions are the files the index covers: the text formats
+// the viewer shows and the editor saves.
+var searchableExtensions = map[string]bool{
+	".md":       true,
+	".markdown": true,
+	".txt":      true,
+	".json":     true,
+}
+
+// SearchFragment is a piece of a result snippet; Match marks the pieces
+// that matched the query.
+type SearchFragment struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+type SearchResult struct {
+	Path    string           `json:"path"`
+	Name    string           `json:"name"`
+	Score   float64          `json:"score"`
+	Snippet []SearchFragment `json:"snippet"`
+}
+
+// searchToken is a term and where it came from in the source text.
+type searchToken struct {
+	term       string
+	start, end int
+}
+
+// isCJK reports whether r belongs to a script written without spaces
+// between words.
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// tokenize splits text into lower-cased words. Runs of CJK characters,
+// which have no word boundaries we could find without a dictionary,
+// become overlapping bigrams instead, so "文件管理" is indexed as 文件,
+// 件管 and 管理; a lone CJK character is kept as a term of its own.
+// Tokens are numbered by their index, which is what phrase queries use.
+func tokenize(text string) []searchToken {
+	var tokens []searchToken
+	var run []searchToken
+	flushRun := func() {
+		if len(run) == 1 {
+			tokens = append(tokens, run[0])
+		}
+		for i := 0; i+1 < len(run); i++ {
+			tokens = append(tokens, searchToken{term: run[i].term + run[i+1].term, start: run[i].start, end: run[i+1].end})
+		}
+		run = run[:0]
+	}
+	wordStart := -1
+	flushWord := func(end int) {
+		if wordStart >= 0 {
+			tokens = append(tokens, searchToken{term: strings.ToLower(text[wordStart:end]), start: wordStart, end: end})
+			wordStart = -1
+		}
+	}
+	for i, r := range text {
+		switch {
+		case isCJK(r):
+			flushWord(i)
+			run = append(run, searchToken{term: string(r), start: i, end: i + utf8.RuneLen(r)})
+		case unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_':
+			flushRun()
+			if wordStart < 0 {
+				wordStart = i
+			}
+		default:
+			flushWord(i)
+			flushRun()
+		}
+	}
+	flushWord(len(text))
+	flushRun()
+	return tokens
+}
+
+// searchClause is one word or phrase of a query: terms that must appear
+// in a row. A lone CJK character is matched on its own or within any
+// bigram containing it.
+type searchClause struct {
+	terms []string
+	char  rune
+}
+
+// searchQuery is a parsed query. A document matches when it contains
+// every clause and none of the excluded ones, passes at least one of the
+// path filters, if any, and none of the excluded path filters.
+type searchQuery struct {
+	clauses      []searchClause
+	excluded     []searchClause
+	paths        []string
+	excludePaths []string
+}
+
+// parseSearchQuery splits q at spaces. "Double quotes" group words into a
+// phrase, and path:<filter>, which may be quoted too, restricts the files
+// searched. A leading minus, as in -draft or -path:archive, turns a word,
+// phrase or path filter into one that rules files out. A word that
+// tokenizes into several terms, such as a run of Chinese text or
+// "e-mail", is matched as a phrase.
+func parseSearchQuery(q string) searchQuery {
+	q = strings.NewReplacer("“", `"`, "”", `"`).Replace(q)
+	var query searchQuery
+	for {
+		q = strings.TrimLeftFunc(q, unicode.IsSpace)
+		if q == "" {
+			return query
+		}
+		negate := strings.HasPrefix(q, "-")
+		if negate {
+			q = q[1:]
+		}
+		isPath := strings.HasPrefix(q, "path:")
+		if isPath {
+			q = q[len("path:"):]
+		}
+		var field string
+		if strings.HasPrefix(q, `"`) {
+			if end := strings.IndexByte(q[1:], '"'); end >= 0 {
+				field, q = q[1:end+1], q[end+2:]
+			} else {
+				field, q = q[1:], ""
+			}
+		} else {
+			end := strings.IndexFunc(q, unicode.IsSpace)
+			if end < 0 {
+				end = len(q)
+			}
+			field, q = q[:end], q[end:]
+		}
+
+		if isPath {
+			if filter := strings.Trim(field, "/"); filter == "" {
+				continue
+			} else if negate {
+				query.excludePaths = append(query.excludePaths, filter)
+			} else {
+				query.paths = append(query.paths, filter)
+			}
+			continue
+		}
+		tokens := tokenize(field)
+		if len(tokens) == 0 {
+			continue
+		}
+		var clause searchClause
+		if r, size := utf8.DecodeRuneInString(tokens[0].term); len(tokens) == 1 && size == len(tokens[0].term) && isCJK(r) {
+			clause.char = r
+		} else {
+			clause.terms = make([]string, len(tokens))
+			for i, token := range tokens {
+				clause.terms[i] = token.term
+			}
+		}
+		if negate {
+			query.excluded = append(query.excluded, clause)
+		} else {
+			query.clauses = append(query.clauses, clause)
+		}
+	}
+}
+
+// matchesPath reports whether relPath passes the query's path filters. A
+// filter with wildcards is a glob, matched against the file name unless
+// it contains a slash; any other filter names a file or directory.
+func (q searchQuery) matchesPath(relPath string) bool {
+	for _, filter := range q.excludePaths {
+		if pathFilterMatches(filter, relPath) {
+			return false
+		}
+	}
+	if len(q.paths) == 0 {
+		return true
+	}
+	for _, filter := range q.paths {
+		if pathFilterMatches(filter, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func pathFilterMatches(filter, relPath string) bool {
+	switch {
+	case !strings.ContainsAny(filter, "*?["):
+		return relWithin(relPath, filter)
+	case strings.Contains(filter, "/"):
+		return matchGlobSegments(splitSegments(filter), splitSegments(relPath))
+	default:
+		ok, _ := path.Match(filter, path.Base(relPath))
+		return ok
+	}
+}
+
+// relWithin reports whether the data-dir relative path relPath is dir or
+// lies below it; every path lies within the root, "".
+func relWithin(relPath, dir string) bool {
+	return dir == "" || relPath == dir || strings.HasPrefix(relPath, dir+"/")
+}
+
+// searchDoc is an indexed file. gen is the sync that indexed it, so a
+// slower sync that started earlier does not replace it with older data.
+type searchDoc struct {
+	modTime time.Time
+	size    int64
+	content string
+	terms   []string
+	gen     uint64
+}
+
+// SearchManager keeps an in-memory inverted index of the text files in
+// the data dir. Handlers refresh the paths they change; a periodic
+// rescan picks up changes made on disk behind the server's back. Files
+// reached through a symlink are not indexed. Files matched by ignore
+// rules are, so admins can search them; Search leaves them out otherwise.
+type SearchManager struct {
+	mu         sync.RWMutex
+	dataDir    string
+	docs       map[string]*searchDoc
+	postings   map[string]map[string][]int
+	generation uint64
+	rescan     *backgroundJob
+}
+
+var globalSearchManager *SearchManager
+
+// InitSearchManager starts the job that builds the index and keeps
+// rescanning the data dir. Searches made before the first scan finishes
+// only see the files indexed so far.
+func InitSearchManager(dataDir string) {
+	sm := &SearchManager{
+		dataDir:  dataDir,
+		docs:     make(map[string]*searchDoc),
+		postings: make(map[string]map[string][]int),
+	}
+	globalSearchManager = sm
+	sm.rescan = startJob(searchRescanInterval, true, sm.rescanOnce)
+}
+
+// Close stops the rescan job.
+func (sm *SearchManager) Close() {
+	sm.rescan.Stop()
+}
+
+func GetSearchManager() *SearchManager {
+	return globalSearchManager
+}
+
+// add indexes doc under relPath. Callers must hold sm.mu and have removed
+// any previous document at relPath.
+func (sm *SearchManager) add(relPath string, doc *searchDoc) {
+	positions := make(map[string][]int)
+	for i, token := range tokenize(doc.content) {
+		positions[token.term] = append(positions[token.term], i)
+	}
+	doc.terms = make([]string, 0, len(positions))
+	for term, list := range positions {
+		doc.terms = append(doc.terms, term)
+		if sm.postings[term] == nil {
+			sm.postings[term] = make(map[string][]int)
+		}
+		sm.postings[term][relPath] = list
+	}
+	sm.docs[relPath] = doc
+}
+
+// remove drops the document at relPath. Callers must hold sm.mu.
+func (sm *SearchManager) remove(relPath string) {
+	doc, ok := sm.docs[relPath]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms {
+		delete(sm.postings[term], relPath)
+		if len(sm.postings[term]) == 0 {
+			delete(sm.postings, term)
+		}
+	}
+	delete(sm.docs, relPath)
+}
+
+// walk lists the indexable files at or below relPath, leaving out the
+// system directory and anything reached through a symlink.
+func (sm *SearchManager) walk(relPath string) (map[string]os.FileInfo, error) {
+	found := make(map[string]os.FileInfo)
+	root := filepath.Join(sm.dataDir, filepath.FromSlash(relPath))
+	if throughSymlink(sm.dataDir, root) {
+		return found, nil
+	}
+	info, err := os.Lstat(root)
+	if os.IsNotExist(err) {
+		return found, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return found, nil
+	}
+
+	systemDir := filepath.Join(sm.dataDir, systemDirName)
+	err = filepath.WalkDir(root, func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if fullPath == root {
+				return err
+			}
+			return nil
+		}
+		if fullPath == systemDir {
+			return filepath.SkipDir
+		}
+		rel := toRelative(sm.dataDir, fullPath)
+		if !entry.Type().IsRegular() || !searchableExtensions[strings.ToLower(filepath.Ext(rel))] {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.Size() <= searchMaxFileSize {
+			found[rel] = info
+		}
+		return nil
+	})
+	return found, err
+}
+
+// readDoc reads the file at relPath, taking its size and modification
+// time from the open file so they describe the content read.
+func (sm *SearchManager) readDoc(relPath string, gen uint64) (*searchDoc, error) {
+	f, err := os.Open(filepath.Join(sm.dataDir, filepath.FromSlash(relPath)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(f, searchMaxFileSize))
+	if err != nil {
+		return nil, err
+	}
+	return &searchDoc{modTime: info.ModTime(), size: info.Size(), content: string(data), gen: gen}, nil
+}
+
+// sync re-indexes the files at or below relPath that changed since they
+// were indexed and drops the documents whose files are gone. It returns
+// how many documents were added, updated or removed.
+func (sm *SearchManager) sync(relPath string) (int, error) {
+	sm.mu.Lock()
+	sm.generation++
+	gen := sm.generation
+	sm.mu.Unlock()
+
+	found, err := sm.walk(relPath)
+	if err != nil {
+		return 0, err
+	}
+	var stale []string
+	sm.mu.RLock()
+	for rel, info := range found {
+		doc, ok := sm.docs[rel]
+		if !ok || !doc.modTime.Equal(info.ModTime()) || doc.size != info.Size() {
+			stale = append(stale, rel)
+		}
+	}
+	sm.mu.RUnlock()
+
+	// Files are read without holding the lock, so searches can go on
+	// while a large tree is indexed.
+	updated := make(map[string]*searchDoc, len(stale))
+	for _, rel := range stale {
+		if doc, err := sm.readDoc(rel, gen); err == nil {
+			updated[rel] = doc
+		} else {
+			delete(found, rel)
+		}
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	changed := 0
+	for rel, doc := range sm.docs {
+		if _, ok := found[rel]; !ok && doc.gen <= gen && relWithin(rel, relPath) {
+			sm.remove(rel)
+			changed++
+		}
+	}
+	for rel, doc := range updated {
+		if old, ok := sm.docs[rel]; ok {
+			if old.gen > gen {
+				continue
+			}
+			sm.remove(rel)
+		}
+		sm.add(rel, doc)
+		changed++
+	}
+	return changed, nil
+}
+
+// Refresh brings the index in line with whatever is now at the data-dir
+// relative path relPath, a file, a directory or nothing at all. Handlers
+// call it after every change they make to the data dir.
+func (sm *SearchManager) Refresh(relPath string) {
+	if _, err := sm.sync(relPath); err != nil {
+		fmt.Printf("Search index update for %q failed: %v\n", relPath, err)
+	}
+}
+
+func (sm *SearchManager) rescanOnce() {
+	changed, err := sm.sync("")
+	if err != nil {
+		fmt.Printf("Search index rescan failed: %v\n", err)
+	} else if changed > 0 {
+		fmt.Printf("Search index updated for %d file(s)\n", changed)
+	}
+}
+
+// phraseAt reports whether terms follow one another in the document at
+// relPath, starting at position pos. Callers must hold sm.mu.
+func (sm *SearchManager) phraseAt(relPath string, terms []string, pos int) bool {
+	for i, term := range terms {
+		positions := sm.postings[term][relPath]
+		j := sort.SearchInts(positions, pos+i)
+		if j == len(positions) || positions[j] != pos+i {
+			return false
+		}
+	}
+	return true
+}
+
+// clauseHits counts the occurrences of clause per document. Callers must
+// hold sm.mu.
+func (sm *SearchManager) clauseHits(clause searchClause) map[string]int {
+	hits := make(map[string]int)
+	if clause.char != 0 {
+		for term, docs := range sm.postings {
+			if utf8.RuneCountInString(term) <= 2 && strings.ContainsRune(term, clause.char) {
+				for rel, positions := range docs {
+					hits[rel] += len(positions)
+				}
+			}
+		}
+		return hits
+	}
+	for rel, positions := range sm.postings[clause.terms[0]] {
+		count := 0
+		for _, pos := range positions {
+			if sm.phraseAt(rel, clause.terms[1:], pos+1) {
+				count++
+			}
+		}
+		if count > 0 {
+			hits[rel] = count
+		}
+	}
+	return hits
+}
+
+// Search returns the documents below scope that match query and that user
+// may read, best first, at most limit of them, along with how many there
+// are in all. Documents matched by ignore rules are left out unless
+// showHidden is set, as in the tree. Documents are ranked by the sum of each clause's
+// log-scaled occurrence count weighted by how rare the clause is.
+func (sm *SearchManager) Search(query searchQuery, scope string, user *User, showHidden bool, limit int) ([]SearchResult, int) {
+	type candidate struct {
+		path    string
+		score   float64
+		content string
+	}
+	var candidates []candidate
+
+	sm.mu.RLock()
+	var scores map[string]float64
+	for i, clause := range query.clauses {
+		hits := sm.clauseHits(clause)
+		idf := math.Log(1 + float64(len(sm.docs))/float64(len(hits)+1))
+		next := make(map[string]float64, len(hits))
+		for rel, count := range hits {
+			score, ok := scores[rel]
+			if i > 0 && !ok {
+				continue
+			}
+			next[rel] = score + idf*(1+math.Log(float64(count)))
+		}
+		if scores = next; len(scores) == 0 {
+			break
+		}
+	}
+	for _, clause := range query.excluded {
+		for rel := range sm.clauseHits(clause) {
+			delete(scores, rel)
+		}
+	}
+	for rel, score := range scores {
+		if relWithin(rel, scope) && query.matchesPath(rel) {
+			candidates = append(candidates, candidate{path: rel, score: score, content: sm.docs[rel].content})
+		}
+	}
+	sm.mu.RUnlock()
+
+	pm := GetPermissionManager()
+	im := GetIgnoreManager()
+	visible := candidates[:0]
+	for _, c := range candidates {
+		if pm.Check(user, c.path, ActionRead) && (showHidden || !im.PathIgnored(c.path, false)) {
+			visible = append(visible, c)
+		}
+	}
+	sort.Slice(visible, func(i, j int) bool {
+		if visible[i].score != visible[j].score {
+			return visible[i].score > visible[j].score
+		}
+		return visible[i].path < visible[j].path
+	})
+
+	total := len(visible)
+	if len(visible) > limit {
+		visible = visible[:limit]
+	}
+	results := make([]SearchResult, 0, len(visible))
+	for _, c := range visible {
+		results = append(results, SearchResult{
+			Path:    c.path,
+			Name:    path.Base(c.path),
+			Score:   math.Round(c.score*1000) / 1000,
+			Snippet: searchSnippet(c.content, query.clauses),
+		})
+	}
+	return results, total
+}
+
+// matchSpans returns the byte ranges of content matched by clauses,
+// sorted and merged.
+func matchSpans(content string, tokens []searchToken, clauses []searchClause) [][2]int {
+	var spans [][2]int
+	for i, token := range tokens {
+		for _, clause := range clauses {
+			if clause.char != 0 {
+				if j := strings.IndexRune(token.term, clause.char); j >= 0 && isCJK(clause.char) {
+					spans = append(spans, [2]int{token.start + j, token.start + j + utf8.RuneLen(clause.char)})
+				}
+				continue
+			}
+			n := len(clause.terms)
+			if i+n > len(tokens) {
+				continue
+			}
+			matched := true
+			for k, term := range clause.terms {
+				if tokens[i+k].term != term {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				spans = append(spans, [2]int{token.start, tokens[i+n-1].end})
+			}
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	merged := spans[:0]
+	for _, span := range spans {
+		if last := len(merged) - 1; last >= 0 && span[0] <= merged[last][1] {
+			merged[last][1] = max(merged[last][1], span[1])
+		} else {
+			merged = append(merged, span)
+		}
+	}
+	return merged
+}
+
+// searchSnippet cuts the text around the first match out of content and
+// splits it into fragments, marking every match in it. Runs of
+// whitespace, line breaks included, are shown as one space.
+func searchSnippet(content string, clauses []searchClause) []SearchFragment {
+	spans := matchSpans(content, tokenize(content), clauses)
+	start := 0
+	if len(spans) > 0 {
+		start = spans[0][0]
+	}
+	for n := 0; start > 0 && n < searchSnippetLead; n++ {
+		_, size := utf8.DecodeLastRuneInString(content[:start])
+		start -= size
+	}
+	end := start
+	for n := 0; end < len(content) && n < searchSnippetLength; n++ {
+		_, size := utf8.DecodeRuneInString(content[end:])
+		end += size
+	}
+	window := content[start:end]
+	start += len(window) - len(strings.TrimLeftFunc(window, unicode.IsSpace))
+	end -= len(window) - len(strings.TrimRightFunc(window, unicode.IsSpace))
+
+	var fragments []SearchFragment
+	appendText := func(text string, match bool) {
+		var b strings.Builder
+		space := false
+		for _, r := range text {
+			if unicode.IsSpace(r) {
+				if !space {
+					b.WriteByte(' ')
+				}
+				space = true
+				continue
+			}
+			space = false
+			b.WriteRune(r)
+		}
+		if b.Len() > 0 {
+			fragments = append(fragments, SearchFragment{Text: b.String(), Match: match})
+		}
+	}
+	if strings.TrimSpace(content[:start]) != "" {
+		fragments = append(fragments, SearchFragment{Text: "…"})
+	}
+	pos := start
+	for _, span := range spans {
+		if span[1] <= pos || span[0] >= end {
+			continue
+		}
+		from, to := max(span[0], pos), min(span[1], end)
+		appendText(content[pos:from], false)
+		appendText(content[from:to], true)
+		pos = to
+	}
+	appendText(content[pos:end], false)
+	if strings.TrimSpace(content[end:]) != "" {
+		fragments = append(fragments, SearchFragment{Text: "…"})
+	}
+	return fragments
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []searchToken
+	}{
+		{"ascii", "Hello, World_1!", []searchToken{{"hello", 0, 5}, {"world_1", 7, 14}}},
+		{"cjk bigrams", "文件管理", []searchToken{{"文件", 0, 6}, {"件管", 3, 9}, {"管理", 6, 12}}},
+		{"lone cjk", "文 件", []searchToken{{"文", 0, 3}, {"件", 4, 7}}},
+		{"mixed", "Go语言 v2", []searchToken{{"go", 0, 2}, {"语言", 2, 8}, {"v2", 9, 11}}},
+		{"kana and hangul", "カナ한글", []searchToken{{"カナ", 0, 6}, {"ナ한", 3, 9}, {"한글", 6, 12}}},
+		{"punctuation only", " -- ", nil},
+	}
+	for _, tt := range tests {
+		if got := tokenize(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: tokenize(%q) = %v, want %v", tt.name, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want searchQuery
+	}{
+		{"Foo bar", searchQuery{clauses: []searchClause{{terms: []string{"foo"}}, {terms: []string{"bar"}}}}},
+		{`"foo bar" baz`, searchQuery{clauses: []searchClause{{terms: []string{"foo", "bar"}}, {terms: []string{"baz"}}}}},
+		{`“foo bar”`, searchQuery{clauses: []searchClause{{terms: []string{"foo", "bar"}}}}},
+		{`"foo`, searchQuery{clauses: []searchClause{{terms: []string{"foo"}}}}},
+		{"e-mail", searchQuery{clauses: []searchClause{{terms: []string{"e", "mail"}}}}},
+		{"文件管理", searchQuery{clauses: []searchClause{{terms: []string{"文件", "件管", "管理"}}}}},
+		{"文", searchQuery{clauses: []searchClause{{char: '文'}}}},
+		{"foo path:/notes/ path:*.md", searchQuery{clauses: []searchClause{{terms: []string{"foo"}}}, paths: []string{"notes", "*.md"}}},
+		{`path:"my notes" foo`, searchQuery{clauses: []searchClause{{terms: []string{"foo"}}}, paths: []string{"my notes"}}},
+		{"foo -bar", searchQuery{clauses: []searchClause{{terms: []string{"foo"}}}, excluded: []searchClause{{terms: []string{"bar"}}}}},
+		{`foo -"bar baz" -草`, searchQuery{clauses: []searchClause{{terms: []string{"foo"}}}, excluded: []searchClause{{terms: []string{"bar", "baz"}}, {char: '草'}}}},
+		{"foo -path:archive", searchQuery{clauses: []searchClause{{terms: []string{"foo"}}}, excludePaths: []string{"archive"}}},
+		{"-foo", searchQuery{excluded: []searchClause{{terms: []string{"foo"}}}}},
+		{"- path: ! ", searchQuery{}},
+	}
+	for _, tt := range tests {
+		if got := parseSearchQuery(tt.q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSearchQuery(%q) = %+v, want %+v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestSearchMatchesPath(t *testing.T) {
+	tests := []struct {
+		q    string
+		path string
+		want bool
+	}{
+		{"x", "notes/a.md", true},
+		{"x path:notes", "notes/a.md", true},
+		{"x path:notes", "notes2/a.md", false},
+		{"x path:*.md", "deep/dir/a.md", true},
+		{"x path:notes/*.md", "notes/sub/a.md", false},
+		{"x path:notes/**/*.md", "notes/sub/a.md", true},
+		{"x path:a path:b", "b/c.md", true},
+		{"x -path:archive", "archive/a.md", false},
+		{"x -path:archive", "notes/a.md", true},
+		{"x path:notes -path:*.json", "notes/a.json", false},
+	}
+	for _, tt := range tests {
+		if got := parseSearchQuery(tt.q).matchesPath(tt.path); got != tt.want {
+			t.Errorf("parseSearchQuery(%q).matchesPath(%q) = %v, want %v", tt.q, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	dataDir := newTestDataDir(t)
+	writeTestFile(t, dataDir, "many.md", "needle needle needle haystack")
+	writeTestFile(t, dataDir, "one.md", "needle haystack")
+	writeTestFile(t, dataDir, "rare.md", "needle rare")
+	writeTestFile(t, dataDir, "none.md", "haystack")
+	writeTestFile(t, dataDir, "phrase.md", "文件管理 needle")
+	writeTestFile(t, dataDir, "split.md", "文件 管理")
+	writeTestFile(t, dataDir, "notes/deep.md", "needle")
+	GetSearchManager().Refresh("")
+
+	// More occurrences and rarer clauses rank higher; equal scores are
+	// ordered by path.
+	tests := []struct {
+		q     string
+		scope string
+		want  []string
+	}{
+		{"needle", "", []string{"many.md", "notes/deep.md", "one.md", "phrase.md", "rare.md"}},
+		{"needle rare", "", []string{"rare.md"}},
+		{"needle haystack", "", []string{"many.md", "one.md"}},
+		{"needle -haystack", "", []string{"notes/deep.md", "phrase.md", "rare.md"}},
+		{"needle -path:notes", "", []string{"many.md", "one.md", "phrase.md", "rare.md"}},
+		{"needle", "notes", []string{"notes/deep.md"}},
+		{"文件管理", "", []string{"phrase.md"}},
+		{`"文件 管理"`, "", []string{"split.md"}},
+		{"管", "", []string{"phrase.md", "split.md"}},
+		{"absent", "", nil},
+	}
+	for _, tt := range tests {
+		results, total := GetSearchManager().Search(parseSearchQuery(tt.q), tt.scope, nil, false, maxSearchLimit)
+		var got []string
+		for i, result := range results {
+			got = append(got, result.Path)
+			if i > 0 && result.Score > results[i-1].Score {
+				t.Errorf("%q: %s scores %v, above %s at %v", tt.q, result.Path, result.Score, results[i-1].Path, results[i-1].Score)
+			}
+		}
+		if total != len(tt.want) {
+			t.Errorf("%q: total = %d, want %d", tt.q, total, len(tt.want))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q in %q = %v, want %v", tt.q, tt.scope, got, tt.want)
+		}
+	}
+
+	results, total := GetSearchManager().Search(parseSearchQuery("needle"), "", nil, false, 2)
+	if len(results) != 2 || total != 5 {
+		t.Errorf("limit 2: %d results of %d, want 2 of 5", len(results), total)
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	fragmentTexts := func(fragments []SearchFragment) string {
+		var b strings.Builder
+		for _, f := range fragments {
+			if f.Match {
+				b.WriteString("[" + f.Text + "]")
+			} else {
+				b.WriteString(f.Text)
+			}
+		}
+		return b.String()
+	}
+	tests := []struct {
+		name    string
+		content string
+		q       string
+		want    string
+	}{
+		{"ascii", "alpha beta gamma", "beta", "alpha [beta] gamma"},
+		{"whitespace", "a\n\n  needle \t b\n", "needle", "a [needle] b"},
+		{"phrase", "one two three", `"two three"`, "one [two three]"},
+		{"cjk bigram", "我们的文件管理器", "文件管理", "我们的[文件管理]器"},
+		{"lone cjk", "管理文件", "理", "管[理]文件"},
+		{"no match", "plain text", "absent", "plain text"},
+		{
+			"lead on multi-byte text",
+			strings.Repeat("文", 100) + "目标" + strings.Repeat("字", 300),
+			"目标",
+			"…" + strings.Repeat("文", searchSnippetLead) + "[目标]" + strings.Repeat("字", searchSnippetLength-searchSnippetLead-2) + "…",
+		},
+		{
+			"cut inside a match",
+			strings.Repeat("字", 10) + "目标" + strings.Repeat("文", 147) + "目标目标",
+			"目标",
+			strings.Repeat("字", 10) + "[目标]" + strings.Repeat("文", 147) + "[目]…",
+		},
+	}
+	for _, tt := range tests {
+		fragments := searchSnippet(tt.content, parseSearchQuery(tt.q).clauses)
+		for _, f := range fragments {
+			if !utf8.ValidString(f.Text) {
+				t.Errorf("%s: fragment %q is not valid UTF-8", tt.name, f.Text)
+			}
+		}
+		if got := fragmentTexts(fragments); got != tt.want {
+			t.Errorf("%s: snippet = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SessionStore persists sessions keyed by Session.TokenHash.
+type SessionStore interface {
+	Get(tokenHash string) (Session, bool, error)
+	Put(session Session) error
+	Delete(tokenHash string) error
+	DeleteWhere(match func(Session) bool) error
+}
+
+// OpenSessionStore returns the store selected by kind: "memory" (the
+// default) keeps sessions in process, "file" keeps them in
+// <userDir>/sessions.json so logins survive a restart.
+func OpenSessionStore(kind, userDir string) (SessionStore, error) {
+	switch kind {
+	case "", "memory":
+		return newMemorySessionStore(), nil
+	case "file":
+		return newFileSessionStore(filepath.Join(userDir, "sessions.json"))
+	default:
+		return nil, fmt.Errorf("unknown session store %q", kind)
+	}
+}
+
+type memorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]Session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		sessions: make(map[string]Session),
+	}
+}
+
+func (ms *memorySessionStore) Get(tokenHash string) (Session, bool, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	session, exists := ms.sessions[tokenHash]
+	return session, exists, nil
+}
+
+func (ms *memorySessionStore) Put(session Session) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.sessions[session.TokenHash] = session
+	return nil
+}
+
+func (ms *memorySessionStore) Delete(tokenHash string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.sessions, tokenHash)
+	return nil
+}
+
+func (ms *memorySessionStore) DeleteWhere(match func(Session) bool) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for tokenHash, session := range ms.sessions {
+		if match(session) {
+			delete(ms.sessions, tokenHash)
+		}
+	}
+	return nil
+}
+
+// fileSessionStore keeps an in-memory copy of the sessions and rewrites the
+// whole file after every change.
+type fileSessionStore struct {
+	mem      *memorySessionStore
+	mu       sync.Mutex
+	filePath string
+}
+
+func newFileSessionStore(filePath string) (*fileSessionStore, error) {
+	fs := &fileSessionStore{
+		mem:      newMemorySessionStore(),
+		filePath: filePath,
+	}
+	if err := fs.load(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *fileSessionStore) load() error {
+	file, err := os.Open(fs.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	var sessions []Session
+	if err := json.NewDecoder(file).Decode(&sessions); err != nil {
+		// A damaged session file only costs everyone a fresh login.
+		fmt.Printf("Ignoring unreadable session file %s: %v\n", fs.filePath, err)
+		return nil
+	}
+	for _, session := range sessions {
+		fs.mem.sessions[session.TokenHash] = session
+	}
+	fmt.Printf("Restored %d session(s) from %s\n", len(sessions), fs.filePath)
+	return nil
+}
+
+// save must be called with fs.mu held.
+func (fs *fileSessionStore) save() error {
+	fs.mem.mu.RLock()
+	sessions := make([]Session, 0, len(fs.mem.sessions))
+	for _, session := range fs.mem.sessions {
+		sessions = append(sessions, session)
+	}
+	fs.mem.mu.RUnlock()
+
+	return writeAtomic(fs.filePath, 0o600, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(sessions)
+	})
+}
+
+func (fs *fileSessionStore) Get(tokenHash string) (Session, bool, error) {
+	return fs.mem.Get(tokenHash)
+}
+
+func (fs *fileSessionStore) Put(session Session) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.mem.Put(session)
+	return fs.save()
+}
+
+func (fs *fileSessionStore) Delete(tokenHash string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, exists, _ := fs.mem.Get(tokenHash); !exists {
+		return nil
+	}
+	fs.mem.Delete(tokenHash)
+	return fs.save()
+}
+
+func (fs *fileSessionStore) DeleteWhere(match func(Session) bool) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	removed := false
+	fs.mem.DeleteWhere(func(session Session) bool {
+		if match(session) {
+			removed = true
+			return true
+		}
+		return false
+	})
+	if !removed {
+		return nil
+	}
+	return fs.save()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSessionStoreSurvivesRestart(t *testing.T) {
+	userDir := t.TempDir()
+	store, err := OpenSessionStore("file", userDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	InitSessionManager(store)
+	t.Cleanup(GetSessionManager().Close)
+	token, err := GetSessionManager().CreateSession("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredToken, err := GetSessionManager().CreateSession("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, _ := store.Get(hashSessionToken(expiredToken))
+	expired.LastActivity = time.Now().Add(-sessionIdleTimeout - time.Minute)
+	if err := store.Put(expired); err != nil {
+		t.Fatal(err)
+	}
+	before, _, _ := store.Get(hashSessionToken(token))
+
+	filePath := filepath.Join(userDir, "sessions.json")
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("session file mode %v, want 0600", mode)
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), token) || strings.Contains(string(data), expiredToken) {
+		t.Errorf("session file holds a raw token:\n%s", data)
+	}
+
+	// A restart reads the file back; the first sweep drops what expired
+	// while the server was down.
+	restarted, err := OpenSessionStore("file", userDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	InitSessionManager(restarted)
+	t.Cleanup(GetSessionManager().Close)
+	after, ok, err := restarted.Get(hashSessionToken(token))
+	if err != nil || !ok {
+		t.Fatalf("session lost over a restart: %v", err)
+	}
+	if after.Username != "bob" || !after.CreatedAt.Equal(before.CreatedAt) || !after.LastActivity.Equal(before.LastActivity) {
+		t.Errorf("restored session %+v, want %+v", after, before)
+	}
+	if _, ok := GetSessionManager().ValidateAndTouch(token); !ok {
+		t.Error("token is not valid after a restart")
+	}
+	if _, ok, _ := restarted.Get(hashSessionToken(expiredToken)); ok {
+		t.Error("expired session survived the restart")
+	}
+	if data, err := os.ReadFile(filePath); err != nil || strings.Contains(string(data), "carol") {
+		t.Errorf("expired session is still on disk: %v\n%s", err, data)
+	}
+}
+
+func TestFileSessionStoreIgnoresDamagedFile(t *testing.T) {
+	userDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(userDir, "sessions.json"), []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenSessionStore("file", userDir)
+	if err != nil {
+		t.Fatalf("OpenSessionStore: %v", err)
+	}
+	if err := store.Put(Session{TokenHash: "x", Username: "bob", CreatedAt: time.Now(), LastActivity: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.Get("x"); !ok {
+		t.Error("session missing after Put")
+	}
+	if _, err := OpenSessionStore("redis", userDir); err == nil {
+		t.Error("unknown store kind was accepted")
+	}
+}
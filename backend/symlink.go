@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// How symlinks inside the data dir are treated, selected with the
+// SYMLINK_POLICY environment variable.
+const (
+	symlinkDeny       = "deny"        // never follow a symlink
+	symlinkWithinRoot = "within-root" // follow links that stay inside the data dir
+	symlinkFollowAll  = "follow-all"  // follow any link but those into the system dir
+)
+
+var (
+	errSymlinkDenied  = errors.New("symlinks are not allowed")
+	errSymlinkEscapes = errors.New("symlink points outside the data directory")
+	errSymlinkBroken  = errors.New("broken or looping symlink")
+	errSymlinkSystem  = errors.New("symlink points into the server's system directory")
+)
+
+// symlinkPolicy is set once at startup, before the server accepts
+// requests.
+var symlinkPolicy = symlinkWithinRoot
+
+func validSymlinkPolicy(policy string) bool {
+	switch policy {
+	case symlinkDeny, symlinkWithinRoot, symlinkFollowAll:
+		return true
+	}
+	return false
+}
+
+// checkSymlinks walks target, a lexically clean path below baseDir, one
+// component at a time and applies symlinkPolicy to every symlink on the
+// way. Components that do not exist yet end the walk, so targets of
+// uploads and creates can be checked too. filepath.EvalSymlinks gives up
+// on link loops, which are reported as broken links except under
+// follow-all. No policy lets a link lead into the system directory, which
+// holds the trash and history copies of protected files.
+func checkSymlinks(baseDir, target string) error {
+	rel, err := filepath.Rel(baseDir, target)
+	if err != nil || rel == "." {
+		return err
+	}
+
+	var realBase string
+	current := baseDir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if symlinkPolicy == symlinkDeny {
+			return errSymlinkDenied
+		}
+		resolved, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			if symlinkPolicy == symlinkFollowAll {
+				return nil
+			}
+			return errSymlinkBroken
+		}
+		if realBase == "" {
+			if realBase, err = filepath.EvalSymlinks(baseDir); err != nil {
+				return err
+			}
+		}
+		if isWithin(resolved, filepath.Join(realBase, systemDirName)) {
+			return errSymlinkSystem
+		}
+		if symlinkPolicy != symlinkFollowAll && !isWithin(resolved, realBase) {
+			return errSymlinkEscapes
+		}
+	}
+	return nil
+}
+
+// throughSymlink reports whether target, a path below baseDir, is a
+// symlink or lies below one, whatever the policy.
+func throughSymlink(baseDir, target string) bool {
+	rel, err := filepath.Rel(baseDir, target)
+	if err != nil || rel == "." {
+		return false
+	}
+	current := baseDir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err != nil {
+			return false
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// linkTarget returns where relPath really leads, relative to baseDir, when
+// it goes through a symlink. Trailing components that do not exist yet are
+// kept as they are. ok is false when no symlink is involved, when the link
+// is broken or loops, or when it leads outside baseDir.
+func linkTarget(baseDir, relPath string) (string, bool) {
+	if baseDir == "" || relPath == "" {
+		return "", false
+	}
+	target := filepath.Join(baseDir, filepath.FromSlash(relPath))
+	if !throughSymlink(baseDir, target) {
+		return "", false
+	}
+	realBase, err := filepath.EvalSymlinks(baseDir)
+	if err != nil {
+		return "", false
+	}
+	existing, rest := target, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			resolved = filepath.Join(resolved, rest)
+			if !isWithin(resolved, realBase) {
+				return "", false
+			}
+			return toRelative(realBase, resolved), true
+		}
+		if !os.IsNotExist(err) || existing == baseDir {
+			return "", false
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+}
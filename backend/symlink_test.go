@@ -0,0 +1,231 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withSymlinkPolicy sets symlinkPolicy for the rest of the test.
+func withSymlinkPolicy(t *testing.T, policy string) {
+	t.Helper()
+	previous := symlinkPolicy
+	symlinkPolicy = policy
+	t.Cleanup(func() { symlinkPolicy = previous })
+}
+
+func mustSymlink(t *testing.T, oldname, newname string) {
+	t.Helper()
+	if err := os.Symlink(oldname, newname); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getRaw fetches relPath from /api/raw as an anonymous caller.
+func getRaw(t *testing.T, server http.Handler, relPath string) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/raw?path="+relPath, nil))
+	return w.Code
+}
+
+func TestSymlinkTargetACL(t *testing.T) {
+	viewer := &User{Username: "viewer", Role: RoleViewer}
+	for _, policy := range []string{symlinkWithinRoot, symlinkFollowAll} {
+		t.Run(policy, func(t *testing.T) {
+			withSymlinkPolicy(t, policy)
+			dataDir := newTestDataDir(t, "/private")
+			writeTestFile(t, dataDir, "public/a.png", "a")
+			writeTestFile(t, dataDir, "private/secret.png", "secret")
+			mustSymlink(t, "../private", filepath.Join(dataDir, "public", "link"))
+			mustSymlink(t, "../private/secret.png", filepath.Join(dataDir, "public", "secret.png"))
+			pm := GetPermissionManager()
+
+			for _, relPath := range []string{"public/link", "public/link/secret.png", "public/link/new.png", "public/secret.png"} {
+				if pm.Check(nil, relPath, ActionRead) {
+					t.Errorf("anonymous may read %s", relPath)
+				}
+				if !pm.Check(viewer, relPath, ActionRead) {
+					t.Errorf("viewer may not read %s", relPath)
+				}
+			}
+
+			server := newTestServer(t, dataDir)
+			for relPath, want := range map[string]int{
+				"public/a.png":           http.StatusOK,
+				"public/link/secret.png": http.StatusForbidden,
+				"public/secret.png":      http.StatusForbidden,
+			} {
+				if got := getRaw(t, server, relPath); got != want {
+					t.Errorf("/api/raw?path=%s = %d, want %d", relPath, got, want)
+				}
+			}
+
+			tree, err := buildTree(dataDir, filepath.Join(dataDir, "public"), TreeOptions{Depth: 2, ProtectedMode: protectedLock})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, child := range tree.Children {
+				if wantLocked := child.Name != "a.png"; child.Locked != wantLocked {
+					t.Errorf("tree node %s locked = %v, want %v", child.Path, child.Locked, wantLocked)
+				}
+				if child.Children != nil {
+					t.Errorf("tree lists the contents of %s", child.Path)
+				}
+			}
+		})
+	}
+}
+
+func TestSymlinkPolicies(t *testing.T) {
+	if _, err := os.Stat("/etc/passwd"); err != nil {
+		t.Skip("no /etc/passwd to link to")
+	}
+	// Each link lives in public/ and file is what /api/raw fetches
+	// through it.
+	links := []struct {
+		name   string
+		target string
+		file   string
+	}{
+		{"inside", "../docs", "b.txt"},
+		{"etc", "/etc", "passwd"},
+		{"up", "../..", "outside.txt"},
+		{"system", "../" + systemDirName, "secret.txt"},
+		{"loop", "loop", "a.txt"},
+	}
+	type outcome struct {
+		resolveErr bool
+		raw        int
+		followed   bool
+	}
+	refused := outcome{resolveErr: true, raw: http.StatusBadRequest}
+	followed := outcome{raw: http.StatusOK, followed: true}
+	tests := []struct {
+		policy string
+		want   map[string]outcome
+	}{
+		{symlinkDeny, map[string]outcome{"inside": refused, "etc": refused, "up": refused, "system": refused, "loop": refused}},
+		{symlinkWithinRoot, map[string]outcome{"inside": followed, "etc": refused, "up": refused, "system": refused, "loop": refused}},
+		{symlinkFollowAll, map[string]outcome{
+			"inside": followed,
+			"etc":    followed,
+			"up":     followed,
+			"system": refused,
+			"loop":   {raw: http.StatusNotFound},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			withSymlinkPolicy(t, tt.policy)
+			dataDir := newTestDataDir(t)
+			writeTestFile(t, dataDir, "public/a.txt", "a")
+			writeTestFile(t, dataDir, "docs/b.txt", "b")
+			writeTestFile(t, dataDir, systemDirName+"/secret.txt", "secret")
+			writeTestFile(t, filepath.Dir(dataDir), "outside.txt", "outside")
+			for _, link := range links {
+				mustSymlink(t, link.target, filepath.Join(dataDir, "public", link.name))
+			}
+			server := newTestServer(t, dataDir)
+			tree, err := buildTree(dataDir, filepath.Join(dataDir, "public"), TreeOptions{Depth: 2, ProtectedMode: protectedLock})
+			if err != nil {
+				t.Fatalf("buildTree: %v", err)
+			}
+			nodes := make(map[string]Node, len(tree.Children))
+			for _, child := range tree.Children {
+				nodes[child.Name] = child
+			}
+
+			for _, link := range links {
+				want := tt.want[link.name]
+				relPath := "public/" + link.name + "/" + link.file
+				if _, err := resolvePath(dataDir, relPath); (err != nil) != want.resolveErr {
+					t.Errorf("resolvePath(%s) error = %v, want error %v", relPath, err, want.resolveErr)
+				}
+				if got := getRaw(t, server, relPath); got != want.raw {
+					t.Errorf("/api/raw?path=%s = %d, want %d", relPath, got, want.raw)
+				}
+				node, ok := nodes[link.name]
+				if !ok {
+					t.Errorf("tree is missing %s", link.name)
+					continue
+				}
+				if !node.Symlink {
+					t.Errorf("tree node %s is not marked as a symlink", link.name)
+				}
+				if got := node.Children != nil; got != want.followed {
+					t.Errorf("tree follows %s = %v, want %v", link.name, got, want.followed)
+				}
+			}
+		})
+	}
+}
+
+func TestCopySymlinks(t *testing.T) {
+	tokens := newTestUsers(t, map[string]Role{"bob": RoleEditor})
+	copyTo := func(t *testing.T, server http.Handler, source, destination string) int {
+		t.Helper()
+		w := serve(server, http.MethodPost, "/api/copy", jsonBody(t, CopyRequest{Source: source, Destination: destination}), tokens["bob"])
+		return w.Code
+	}
+
+	t.Run("relative links keep their meaning", func(t *testing.T) {
+		dataDir := newTestDataDir(t)
+		writeTestFile(t, dataDir, "shared/s.txt", "shared")
+		writeTestFile(t, dataDir, "a/dir/b.txt", "b")
+		writeTestFile(t, dataDir, "x/y/.keep", "")
+		mustSymlink(t, "../../shared/s.txt", filepath.Join(dataDir, "a", "dir", "out"))
+		mustSymlink(t, "b.txt", filepath.Join(dataDir, "a", "dir", "in"))
+		server := newTestServer(t, dataDir)
+
+		if code := copyTo(t, server, "a/dir", "x/y/dir"); code != http.StatusOK {
+			t.Fatalf("copy = %d", code)
+		}
+		for link, want := range map[string]string{"out": "shared", "in": "b"} {
+			data, err := os.ReadFile(filepath.Join(dataDir, "x", "y", "dir", link))
+			if err != nil || string(data) != want {
+				t.Errorf("copied link %s reads %q, %v; want %q", link, data, err, want)
+			}
+		}
+		target, err := os.Readlink(filepath.Join(dataDir, "x", "y", "dir", "in"))
+		if err != nil || target != "b.txt" {
+			t.Errorf("link inside the copy = %q, %v; want it to point into the copy", target, err)
+		}
+	})
+
+	t.Run("links the policy refuses", func(t *testing.T) {
+		dataDir := newTestDataDir(t)
+		writeTestFile(t, dataDir, "a/dir/b.txt", "b")
+		writeTestFile(t, dataDir, "ok/dir/b.txt", "b")
+		mustSymlink(t, "../../..", filepath.Join(dataDir, "a", "dir", "up"))
+		mustSymlink(t, "b.txt", filepath.Join(dataDir, "ok", "dir", "in"))
+		server := newTestServer(t, dataDir)
+
+		if code := copyTo(t, server, "a/dir", "a/copy"); code != http.StatusBadRequest {
+			t.Errorf("copy of a link out of the data dir = %d, want %d", code, http.StatusBadRequest)
+		}
+		withSymlinkPolicy(t, symlinkDeny)
+		if code := copyTo(t, server, "ok/dir", "ok/copy"); code != http.StatusBadRequest {
+			t.Errorf("copy of a link under %s = %d, want %d", symlinkDeny, code, http.StatusBadRequest)
+		}
+		for _, copied := range []string{"a/copy", "ok/copy"} {
+			if _, err := os.Lstat(filepath.Join(dataDir, filepath.FromSlash(copied))); !os.IsNotExist(err) {
+				t.Errorf("%s was created: %v", copied, err)
+			}
+		}
+	})
+
+	t.Run("links to files the caller may not read", func(t *testing.T) {
+		dataDir := newTestDataDir(t, "/private user:alice r")
+		writeTestFile(t, dataDir, "private/p.txt", "p")
+		writeTestFile(t, dataDir, "a/dir/b.txt", "b")
+		mustSymlink(t, "../../private/p.txt", filepath.Join(dataDir, "a", "dir", "p"))
+		server := newTestServer(t, dataDir)
+
+		if code := copyTo(t, server, "a/dir", "a/copy"); code != http.StatusForbidden {
+			t.Errorf("copy = %d, want %d", code, http.StatusForbidden)
+		}
+	})
+}
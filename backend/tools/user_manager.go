@@ -6,11 +6,51 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Role     string   `json:"role"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// validRoles mirrors the roles understood by the server.
+var validRoles = map[string]bool{
+	"admin":  true,
+	"editor": true,
+	"viewer": true,
+}
+
+// parseGroups splits a comma-separated --groups value.
+func parseGroups(value string) []string {
+	var groups []string
+	for _, group := range strings.Split(value, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func checkRole(role string) error {
+	if !validRoles[role] {
+		return fmt.Errorf("invalid role '%s' (expected admin, editor or viewer)", role)
+	}
+	return nil
+}
+
+// hashPassword must produce the same format the server's UserManager
+// verifies: bcrypt in modular crypt form.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
 }
 
 func loadUsers(filePath string) (map[string]User, error) {
@@ -36,39 +76,100 @@ func loadUsers(filePath string) (map[string]User, error) {
 	return users, nil
 }
 
+// saveUsers replaces user.json atomically, so a failed write never leaves
+// the server with an empty or truncated user list.
 func saveUsers(filePath string, users map[string]User) error {
-	file, err := os.Create(filePath)
+	userList := make([]User, 0, len(users))
+	for _, user := range users {
+		userList = append(userList, user)
+	}
+
+	data, err := json.MarshalIndent(userList, "", "  ")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	return writeFileAtomic(filePath, append(data, '\n'), 0o644)
+}
 
-	userList := make([]User, 0, len(users))
-	for _, user := range users {
-		userList = append(userList, user)
+// writeFileAtomic writes data to a temporary file next to filePath, syncs
+// it and renames it into place; it mirrors the server's helper of the same
+// name.
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	if info, err := os.Stat(filePath); err == nil {
+		perm = info.Mode().Perm()
 	}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(userList)
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return err
+	}
+	committed = true
+	return nil
 }
 
-func changeUser(dataDir, username, password string) error {
+// changeUser updates the password, role and/or groups of an existing user;
+// empty values leave the corresponding field untouched.
+func changeUser(dataDir, username, password, role, groups string) error {
 	usersFilePath := filepath.Join(dataDir, "user.json")
 	users, err := loadUsers(usersFilePath)
 	if err != nil {
 		return err
 	}
 
-	if _, exists := users[username]; !exists {
+	user, exists := users[username]
+	if !exists {
 		return fmt.Errorf("user '%s' does not exist", username)
 	}
 
-	users[username] = User{Username: username, Password: password}
+	if password != "" {
+		hash, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+		user.Password = hash
+	}
+	if role != "" {
+		if err := checkRole(role); err != nil {
+			return err
+		}
+		user.Role = role
+	}
+	if groups != "" {
+		user.Groups = parseGroups(groups)
+	}
+	users[username] = user
 	return saveUsers(usersFilePath, users)
 }
 
-func addUser(dataDir, username, password string) error {
+func addUser(dataDir, username, password, role, groups string) error {
+	if err := checkRole(role); err != nil {
+		return err
+	}
+
 	usersFilePath := filepath.Join(dataDir, "user.json")
 	users, err := loadUsers(usersFilePath)
 	if err != nil {
@@ -79,7 +180,11 @@ func addUser(dataDir, username, password string) error {
 		return fmt.Errorf("user '%s' already exists", username)
 	}
 
-	users[username] = User{Username: username, Password: password}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	users[username] = User{Username: username, Password: hash, Role: role, Groups: parseGroups(groups)}
 	return saveUsers(usersFilePath, users)
 }
 
@@ -111,8 +216,16 @@ func listUsers(dataDir string) error {
 	}
 
 	fmt.Println("Users:")
-	for username := range users {
-		fmt.Printf("  - %s\n", username)
+	for username, user := range users {
+		role := user.Role
+		if role == "" {
+			role = "admin (legacy)"
+		}
+		if len(user.Groups) > 0 {
+			fmt.Printf("  - %s [%s] groups: %s\n", username, role, strings.Join(user.Groups, ", "))
+		} else {
+			fmt.Printf("  - %s [%s]\n", username, role)
+		}
 	}
 
 	return nil
@@ -122,6 +235,8 @@ func main() {
 	var dataDir string
 	var username string
 	var password string
+	var role string
+	var groups string
 	var list bool
 	var addUserCmd bool
 	var removeUserCmd bool
@@ -130,10 +245,12 @@ func main() {
 	flag.StringVar(&dataDir, "dir", "../.user", "User data directory")
 	flag.StringVar(&username, "username", "", "Username")
 	flag.StringVar(&password, "password", "", "Password")
+	flag.StringVar(&role, "role", "", "Role: admin, editor or viewer (default viewer for --add)")
+	flag.StringVar(&groups, "groups", "", "Comma-separated groups used by path ACLs")
 	flag.BoolVar(&list, "list", false, "List all users")
 	flag.BoolVar(&addUserCmd, "add", false, "Add a new user")
 	flag.BoolVar(&removeUserCmd, "remove", false, "Remove a user")
-	flag.BoolVar(&changeUserCmd, "change", false, "Change user password")
+	flag.BoolVar(&changeUserCmd, "change", false, "Change user password or role")
 	flag.Parse()
 
 	if list {
@@ -149,11 +266,14 @@ func main() {
 			fmt.Println("Error: --username and --password are required for --add")
 			os.Exit(1)
 		}
-		if err := addUser(dataDir, username, password); err != nil {
+		if role == "" {
+			role = "viewer"
+		}
+		if err := addUser(dataDir, username, password, role, groups); err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
-		fmt.Printf("User '%s' added successfully\n", username)
+		fmt.Printf("User '%s' added successfully with role '%s'\n", username, role)
 		return
 	}
 
@@ -171,23 +291,23 @@ func main() {
 	}
 
 	if changeUserCmd {
-		if username == "" || password == "" {
-			fmt.Println("Error: --username and --password are required for --change")
+		if username == "" || (password == "" && role == "" && groups == "") {
+			fmt.Println("Error: --username and at least one of --password, --role or --groups are required for --change")
 			os.Exit(1)
 		}
-		if err := changeUser(dataDir, username, password); err != nil {
+		if err := changeUser(dataDir, username, password, role, groups); err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
-		fmt.Printf("User '%s' password changed successfully\n", username)
+		fmt.Printf("User '%s' changed successfully\n", username)
 		return
 	}
 
 	fmt.Println("Usage:")
 	fmt.Println("  go run user_manager.go --list")
-	fmt.Println("  go run user_manager.go --add --username <name> --password <password>")
+	fmt.Println("  go run user_manager.go --add --username <name> --password <password> [--role <admin|editor|viewer>] [--groups <g1,g2>]")
 	fmt.Println("  go run user_manager.go --remove --username <name>")
-	fmt.Println("  go run user_manager.go --change --username <name> --password <password>")
+	fmt.Println("  go run user_manager.go --change --username <name> [--password <password>] [--role <admin|editor|viewer>] [--groups <g1,g2>]")
 	fmt.Println("")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
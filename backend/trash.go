@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// systemDirName is the reserved directory in the data root holding server
+// state that must live on the same filesystem as the data (so it can be
+// moved in and out with a rename). It is never exposed through the API.
+const systemDirName = ".filemanager"
+
+const (
+	defaultTrashRetention = 30 * 24 * time.Hour
+	trashPurgeInterval    = time.Hour
+	trashMetaFile         = "meta.json"
+)
+
+var errTrashItemNotFound = errors.New("trash item not found")
+
+// TrashItem describes one deleted file or directory.
+type TrashItem struct {
+	ID           string    `json:"id"`
+	OriginalPath string    `json:"original_path"`
+	Name         string    `json:"name"`
+	Type         string    `json:"type"`
+	DeletedBy    string    `json:"deleted_by"`
+	DeletedAt    time.Time `json:"deleted_at"`
+}
+
+// TrashManager keeps deleted items in <data>/.filemanager/trash/<id>/, next
+// to a meta.json recording where they came from.
+type TrashManager struct {
+	dataDir   string
+	trashDir  string
+	retention time.Duration
+	purge     *backgroundJob
+}
+
+var globalTrashManager *TrashManager
+
+// InitTrashManager prepares the trash directory and starts the job that
+// purges items older than retention; a retention of zero keeps items until
+// they are purged by hand.
+func InitTrashManager(dataDir string, retention time.Duration) error {
+	tm := &TrashManager{
+		dataDir:   dataDir,
+		trashDir:  filepath.Join(dataDir, systemDirName, "trash"),
+		retention: retention,
+	}
+	if err := os.MkdirAll(tm.trashDir, 0o755); err != nil {
+		return err
+	}
+
+	globalTrashManager = tm
+	if retention > 0 {
+		tm.purge = startJob(trashPurgeInterval, true, tm.purgeExpired)
+	}
+	return nil
+}
+
+// Close stops the purge job.
+func (tm *TrashManager) Close() {
+	tm.purge.Stop()
+}
+
+func GetTrashManager() *TrashManager {
+	return globalTrashManager
+}
+
+func newTrashID() (string, error) {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + hex.EncodeToString(buf), nil
+}
+
+// Move puts the file or directory at relPath into the trash.
+func (tm *TrashManager) Move(relPath, deletedBy string) (TrashItem, error) {
+	source := filepath.Join(tm.dataDir, filepath.FromSlash(relPath))
+	info, err := os.Lstat(source)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	id, err := newTrashID()
+	if err != nil {
+		return TrashItem{}, err
+	}
+	item := TrashItem{
+		ID:           id,
+		OriginalPath: relPath,
+		Name:         info.Name(),
+		Type:         "file",
+		DeletedBy:    deletedBy,
+		DeletedAt:    time.Now(),
+	}
+	if info.IsDir() {
+		item.Type = "dir"
+	}
+
+	itemDir := filepath.Join(tm.trashDir, id)
+	if err := os.Mkdir(itemDir, 0o755); err != nil {
+		return TrashItem{}, err
+	}
+	meta, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		os.RemoveAll(itemDir)
+		return TrashItem{}, err
+	}
+	if err := writeFileAtomic(filepath.Join(itemDir, trashMetaFile), meta, 0o644); err != nil {
+		os.RemoveAll(itemDir)
+		return TrashItem{}, err
+	}
+	if err := os.Rename(source, filepath.Join(itemDir, item.Name)); err != nil {
+		os.RemoveAll(itemDir)
+		return TrashItem{}, err
+	}
+	return item, nil
+}
+
+// List returns the trash contents, most recently deleted first.
+func (tm *TrashManager) List() ([]TrashItem, error) {
+	dirEntries, err := os.ReadDir(tm.trashDir)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]TrashItem, 0, len(dirEntries))
+	for _, entry := range dirEntries {
+		if !entry.IsDir() {
+			continue
+		}
+		item, err := tm.Get(entry.Name())
+		if err != nil {
+			fmt.Printf("Skipping unreadable trash item %s: %v\n", entry.Name(), err)
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedAt.After(items[j].DeletedAt)
+	})
+	return items, nil
+}
+
+func (tm *TrashManager) Get(id string) (TrashItem, error) {
+	if id == "" || id != filepath.Base(id) || id == "." || id == ".." {
+		return TrashItem{}, errTrashItemNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(tm.trashDir, id, trashMetaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return TrashItem{}, errTrashItemNotFound
+		}
+		return TrashItem{}, err
+	}
+	var item TrashItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		return TrashItem{}, err
+	}
+	return item, nil
+}
+
+// Contents lists the paths item holds, relative to its original path, as
+// subtreePaths does.
+func (tm *TrashManager) Contents(item TrashItem) ([]string, error) {
+	return subtreePaths(filepath.Join(tm.trashDir, item.ID, item.Name))
+}
+
+// Restore moves item back to targetPath, an absolute path chosen by the
+// caller (normally the original location after conflict handling), and
+// recreates missing parent directories.
+func (tm *TrashManager) Restore(item TrashItem, targetPath string) error {
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
+		return err
+	}
+	itemDir := filepath.Join(tm.trashDir, item.ID)
+	if err := os.Rename(filepath.Join(itemDir, item.Name), targetPath); err != nil {
+		return err
+	}
+	return os.RemoveAll(itemDir)
+}
+
+// Purge deletes an item from the trash for good.
+func (tm *TrashManager) Purge(id string) error {
+	if _, err := tm.Get(id); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(tm.trashDir, id))
+}
+
+// PurgeOlderThan deletes items that were deleted before cutoff and returns
+// how many were removed.
+func (tm *TrashManager) PurgeOlderThan(cutoff time.Time) (int, error) {
+	items, err := tm.List()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, item := range items {
+		if item.DeletedAt.After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(tm.trashDir, item.ID)); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (tm *TrashManager) purgeExpired() {
+	purged, err := tm.PurgeOlderThan(time.Now().Add(-tm.retention))
+	if err != nil {
+		fmt.Printf("Trash purge failed: %v\n", err)
+	} else if purged > 0 {
+		fmt.Printf("Purged %d expired trash item(s)\n", purged)
+	}
+}
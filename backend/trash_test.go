@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	tokens := newTestUsers(t, map[string]Role{"editor": RoleEditor})
+	dataDir := newTestFixture(t)
+	server := newTestServer(t, dataDir)
+	tm := GetTrashManager()
+	expect := func(method, target string, body interface{}, user string, want int) []byte {
+		t.Helper()
+		var reader io.Reader
+		if body != nil {
+			reader = jsonBody(t, body)
+		}
+		w := serve(server, method, target, reader, tokens[user])
+		if w.Code != want {
+			t.Fatalf("%s %s as %s = %d, want %d: %s", method, target, user, w.Code, want, w.Body.String())
+		}
+		return w.Body.Bytes()
+	}
+	remove := func(relPath string) TrashItem {
+		t.Helper()
+		var deleted struct {
+			TrashID string `json:"trash_id"`
+		}
+		body := expect(http.MethodDelete, "/api/file?path="+url.QueryEscape(relPath), nil, "editor", http.StatusOK)
+		if err := json.Unmarshal(body, &deleted); err != nil {
+			t.Fatal(err)
+		}
+		item, err := tm.Get(deleted.TrashID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+	content := func(relPath string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dataDir, filepath.FromSlash(relPath)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// Deleting moves the file out of the tree and records where it was.
+	file := remove("public/del.md")
+	if file.OriginalPath != "public/del.md" || file.Type != "file" || file.DeletedBy != "editor" || file.Name != "del.md" {
+		t.Errorf("trash item %+v", file)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "public", "del.md")); !os.IsNotExist(err) {
+		t.Errorf("public/del.md still exists: %v", err)
+	}
+	dir := remove("public/sub")
+	if dir.Type != "dir" {
+		t.Errorf("trash item for a directory has type %q", dir.Type)
+	}
+	var listed struct {
+		Items []TrashItem `json:"items"`
+	}
+	if err := json.Unmarshal(expect(http.MethodGet, "/api/trash", nil, "editor", http.StatusOK), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Items) != 2 || listed.Items[0].ID != dir.ID || listed.Items[1].ID != file.ID {
+		t.Errorf("trash list %+v, want the directory, then the file", listed.Items)
+	}
+
+	// A restore onto a free path puts the item back as it was.
+	expect(http.MethodPost, "/api/trash", RestoreRequest{ID: dir.ID}, "editor", http.StatusOK)
+	if got := content("public/sub/b.txt"); got != "b" {
+		t.Errorf("restored public/sub/b.txt = %q", got)
+	}
+	if _, err := tm.Get(dir.ID); err != errTrashItemNotFound {
+		t.Errorf("restored item is still in the trash: %v", err)
+	}
+
+	// Name collisions fail, get a free name, or replace what is there,
+	// which goes to the trash in turn.
+	writeTestFile(t, dataDir, "public/del.md", "new")
+	expect(http.MethodPost, "/api/trash", RestoreRequest{ID: file.ID}, "editor", http.StatusConflict)
+	expect(http.MethodPost, "/api/trash", RestoreRequest{ID: file.ID, Conflict: conflictRename}, "editor", http.StatusOK)
+	if got := content("public/del (1).md"); got != "del.md" {
+		t.Errorf("renamed restore holds %q", got)
+	}
+	dir = remove("public/sub")
+	writeTestFile(t, dataDir, "public/sub/c.txt", "c")
+	expect(http.MethodPost, "/api/trash", RestoreRequest{ID: dir.ID, Conflict: conflictRename}, "editor", http.StatusOK)
+	if got := content("public/sub (1)/b.txt"); got != "b" {
+		t.Errorf("renamed directory restore holds %q", got)
+	}
+	file = remove("public/del (1).md")
+	expect(http.MethodPost, "/api/trash", RestoreRequest{ID: file.ID, Conflict: conflictOverwrite}, "editor", http.StatusOK)
+	if got := content("public/del (1).md"); got != "del.md" {
+		t.Errorf("overwriting restore left %q", got)
+	}
+	items, err := tm.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Errorf("trash holds %+v after restoring everything", items)
+	}
+	file = remove("public/del (1).md")
+	writeTestFile(t, dataDir, "public/del (1).md", "replaced")
+	expect(http.MethodPost, "/api/trash", RestoreRequest{ID: file.ID, Conflict: conflictOverwrite}, "editor", http.StatusOK)
+	if items, err = tm.List(); err != nil || len(items) != 1 || items[0].OriginalPath != "public/del (1).md" {
+		t.Errorf("trash holds %+v, %v; want the replaced file", items, err)
+	}
+
+	// Purging removes an item for good; emptying the trash is for admins.
+	expect(http.MethodDelete, "/api/trash?id="+items[0].ID, nil, "editor", http.StatusOK)
+	expect(http.MethodDelete, "/api/trash?id="+items[0].ID, nil, "editor", http.StatusNotFound)
+	remove("public/trash1.md")
+	remove("public/trash2.md")
+	expect(http.MethodDelete, "/api/trash", nil, "editor", http.StatusForbidden)
+	var emptied struct {
+		Purged int `json:"purged"`
+	}
+	if err := json.Unmarshal(expect(http.MethodDelete, "/api/trash", nil, "admin", http.StatusOK), &emptied); err != nil {
+		t.Fatal(err)
+	}
+	if emptied.Purged != 2 {
+		t.Errorf("emptying the trash purged %d items, want 2", emptied.Purged)
+	}
+}
+
+func TestTrashPurgeOlderThan(t *testing.T) {
+	dataDir := newTestDataDir(t)
+	tm := GetTrashManager()
+	var items []TrashItem
+	for _, name := range []string{"old.md", "new.md"} {
+		writeTestFile(t, dataDir, name, name)
+		item, err := tm.Move(name, "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	purged, err := tm.PurgeOlderThan(items[0].DeletedAt)
+	if err != nil || purged != 1 {
+		t.Fatalf("PurgeOlderThan = %d, %v; want 1", purged, err)
+	}
+	if _, err := tm.Get(items[0].ID); err != errTrashItemNotFound {
+		t.Errorf("old item survived: %v", err)
+	}
+	if _, err := tm.Get(items[1].ID); err != nil {
+		t.Errorf("new item was purged: %v", err)
+	}
+
+	// The retention job purges what is older than the retention.
+	tm.retention = time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	tm.purgeExpired()
+	if items, err := tm.List(); err != nil || len(items) != 0 {
+		t.Errorf("trash holds %+v, %v after the retention ran out", items, err)
+	}
+	if err := tm.Purge("../history"); err != errTrashItemNotFound {
+		t.Errorf("Purge outside the trash = %v, want %v", err, errTrashItemNotFound)
+	}
+}
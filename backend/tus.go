@@ -0,0 +1,513 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads following the tus 1.0 protocol (https://tus.io), with
+// the creation, termination and expiration extensions. Uploads are staged
+// in <data>/.filemanager/uploads as <id>.bin next to an <id>.json describing
+// them, and renamed into place once the last byte has arrived.
+const (
+	tusVersion        = "1.0.0"
+	tusExtensions     = "creation,termination,expiration"
+	tusBasePath       = "/api/tus/"
+	defaultTusExpiry  = 24 * time.Hour
+	tusExpireInterval = time.Hour
+)
+
+var errTusUploadNotFound = errors.New("upload not found")
+
+// tusUpload describes one upload in progress. The current offset is not
+// stored: it is the size of the staged data file, which stays correct even
+// when the server dies in the middle of a PATCH.
+type tusUpload struct {
+	ID        string    `json:"id"`
+	Length    int64     `json:"length"`
+	Target    string    `json:"target"`
+	Owner     string    `json:"owner"`
+	Conflict  string    `json:"conflict"`
+	Metadata  string    `json:"metadata,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TusManager keeps the staged uploads and their expiry settings.
+type TusManager struct {
+	mu      sync.Mutex
+	busy    map[string]bool
+	dir     string
+	expiry  time.Duration
+	maxSize int64
+	expire  *backgroundJob
+}
+
+var globalTusManager *TusManager
+
+// InitTusManager prepares the staging directory and starts the job that
+// removes uploads not written to for longer than expiry; an expiry of zero
+// keeps them forever. maxSize limits the length of a single upload; zero
+// means no limit.
+func InitTusManager(dataDir string, expiry time.Duration, maxSize int64) error {
+	tm := &TusManager{
+		busy:    make(map[string]bool),
+		dir:     filepath.Join(dataDir, systemDirName, "uploads"),
+		expiry:  expiry,
+		maxSize: maxSize,
+	}
+	if err := os.MkdirAll(tm.dir, 0o755); err != nil {
+		return err
+	}
+
+	globalTusManager = tm
+	if expiry > 0 {
+		tm.expire = startJob(tusExpireInterval, true, tm.expireAbandoned)
+	}
+	return nil
+}
+
+func GetTusManager() *TusManager {
+	return globalTusManager
+}
+
+func newTusID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func validTusID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func (tm *TusManager) infoPath(id string) string {
+	return filepath.Join(tm.dir, id+".json")
+}
+
+func (tm *TusManager) dataPath(id string) string {
+	return filepath.Join(tm.dir, id+".bin")
+}
+
+// Create registers a new upload of length bytes that will end up at the
+// data-dir relative path target, applying the conflict policy if the name
+// is taken by then.
+func (tm *TusManager) Create(target, owner, conflict string, length int64, metadata string) (tusUpload, error) {
+	id, err := newTusID()
+	if err != nil {
+		return tusUpload{}, err
+	}
+	upload := tusUpload{
+		ID:        id,
+		Length:    length,
+		Target:    target,
+		Owner:     owner,
+		Conflict:  conflict,
+		Metadata:  metadata,
+		CreatedAt: time.Now(),
+	}
+	data, err := json.MarshalIndent(upload, "", "  ")
+	if err != nil {
+		return tusUpload{}, err
+	}
+	file, err := os.OpenFile(tm.dataPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return tusUpload{}, err
+	}
+	file.Close()
+	if err := writeFileAtomic(tm.infoPath(id), data, 0o644); err != nil {
+		os.Remove(tm.dataPath(id))
+		return tusUpload{}, err
+	}
+	return upload, nil
+}
+
+// Get returns the upload id together with its current offset.
+func (tm *TusManager) Get(id string) (tusUpload, int64, error) {
+	if !validTusID(id) {
+		return tusUpload{}, 0, errTusUploadNotFound
+	}
+	data, err := os.ReadFile(tm.infoPath(id))
+	if os.IsNotExist(err) {
+		return tusUpload{}, 0, errTusUploadNotFound
+	} else if err != nil {
+		return tusUpload{}, 0, err
+	}
+	var upload tusUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return tusUpload{}, 0, err
+	}
+	info, err := os.Stat(tm.dataPath(id))
+	if os.IsNotExist(err) {
+		return tusUpload{}, 0, errTusUploadNotFound
+	} else if err != nil {
+		return tusUpload{}, 0, err
+	}
+	return upload, info.Size(), nil
+}
+
+// lock marks an upload as being written, so two PATCH requests for the
+// same upload cannot interleave.
+func (tm *TusManager) lock(id string) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.busy[id] {
+		return false
+	}
+	tm.busy[id] = true
+	return true
+}
+
+func (tm *TusManager) unlock(id string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	delete(tm.busy, id)
+}
+
+// Append writes at most the remaining length of upload from r to the end
+// of its staged data and returns the new offset. Whatever was received is
+// kept when the client goes away, so it can resume from there.
+func (tm *TusManager) Append(upload tusUpload, offset int64, r io.Reader) (int64, error) {
+	file, err := os.OpenFile(tm.dataPath(upload.ID), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return offset, err
+	}
+	written, copyErr := io.Copy(file, io.LimitReader(r, upload.Length-offset))
+	offset += written
+	if err := file.Sync(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if err := file.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	return offset, copyErr
+}
+
+// Finish moves a complete upload to targetPath; both live on the data
+// dir's filesystem, so the file appears there in a single rename. commit
+// runs once the data sits next to targetPath, just before that rename, to
+// clear a file being replaced. If commit fails the upload stays staged.
+func (tm *TusManager) Finish(upload tusUpload, targetPath string, commit func() error) error {
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
+		return err
+	}
+	if err := moveReplacing(tm.dataPath(upload.ID), targetPath, commit); err != nil {
+		return err
+	}
+	return os.Remove(tm.infoPath(upload.ID))
+}
+
+// Terminate discards an upload and everything received for it.
+func (tm *TusManager) Terminate(id string) error {
+	if err := os.Remove(tm.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(tm.infoPath(id))
+}
+
+// setExpires reports in the Upload-Expires header when an upload last
+// written at modTime will be removed.
+func (tm *TusManager) setExpires(w http.ResponseWriter, modTime time.Time) {
+	if tm.expiry > 0 {
+		w.Header().Set("Upload-Expires", modTime.Add(tm.expiry).UTC().Format(http.TimeFormat))
+	}
+}
+
+// ExpireOlderThan removes uploads whose data was last written before
+// cutoff and returns how many were removed.
+func (tm *TusManager) ExpireOlderThan(cutoff time.Time) (int, error) {
+	entries, err := os.ReadDir(tm.dir)
+	if err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !validTusID(id) || !tm.lock(id) {
+			continue
+		}
+		modTime := time.Time{}
+		if info, err := os.Stat(tm.dataPath(id)); err == nil {
+			modTime = info.ModTime()
+		}
+		if modTime.Before(cutoff) {
+			if err := tm.Terminate(id); err != nil {
+				tm.unlock(id)
+				return expired, err
+			}
+			expired++
+		}
+		tm.unlock(id)
+	}
+	return expired, nil
+}
+
+// Close stops the expiry job.
+func (tm *TusManager) Close() {
+	tm.expire.Stop()
+}
+
+func (tm *TusManager) expireAbandoned() {
+	expired, err := tm.ExpireOlderThan(time.Now().Add(-tm.expiry))
+	if err != nil {
+		fmt.Printf("Expiring uploads failed: %v\n", err)
+	} else if expired > 0 {
+		fmt.Printf("Removed %d abandoned upload(s)\n", expired)
+	}
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated
+// "key base64value" pairs, where the value may be left out.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata value for %q", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// tusHandler serves the tus endpoint: POST /api/tus?path=<dir>&conflict=
+// creates an upload named by the "filename" metadata (which may contain
+// directories), and HEAD, PATCH and DELETE on the returned /api/tus/<id>
+// resume, append to and terminate it. Only the user who created an upload
+// can see it. Conflict works as for /api/upload and defaults to "rename".
+func tusHandler(baseDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tm := GetTusManager()
+
+		// finish moves a complete upload into place, checking permissions
+		// again since the rules may have changed while it was running.
+		finish := func(upload tusUpload) bool {
+			destPath, err := resolvePath(baseDir, upload.Target)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return false
+			}
+			targetPath, replace, err := resolveConflict(destPath, upload.Conflict)
+			if errors.Is(err, errTargetExists) {
+				writeError(w, http.StatusConflict, "file already exists")
+				return false
+			} else if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return false
+			}
+			targetRel := toRelative(baseDir, targetPath)
+			if !allowPath(w, r, targetRel, ActionWrite) {
+				return false
+			}
+			if replace {
+				if info, err := os.Stat(targetPath); err == nil && info.IsDir() {
+					writeError(w, http.StatusConflict, "a directory with this name exists")
+					return false
+				}
+				if !allowPath(w, r, targetRel, ActionDelete) {
+					return false
+				}
+			}
+			// The replaced file only goes to the trash once the upload is
+			// ready to take its place.
+			if err := tm.Finish(upload, targetPath, func() error {
+				if !replace {
+					return nil
+				}
+				_, err := GetTrashManager().Move(targetRel, upload.Owner)
+				return err
+			}); err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return false
+			}
+			GetSearchManager().Refresh(targetRel)
+			return true
+		}
+
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.Header().Set("Tus-Extension", tusExtensions)
+			if tm.maxSize > 0 {
+				w.Header().Set("Tus-Max-Size", strconv.FormatInt(tm.maxSize, 10))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			writeError(w, http.StatusPreconditionFailed, "unsupported tus version")
+			return
+		}
+		user := requestUser(r)
+
+		id := strings.TrimPrefix(r.URL.Path, tusBasePath)
+		if id == r.URL.Path || id == "" {
+			if r.Method != http.MethodPost {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+			if err != nil || length < 0 {
+				writeError(w, http.StatusBadRequest, "invalid Upload-Length")
+				return
+			}
+			if tm.maxSize > 0 && length > tm.maxSize {
+				writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("upload exceeds the limit of %d bytes", tm.maxSize))
+				return
+			}
+			metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			dirPath, err := resolvePath(baseDir, r.URL.Query().Get("path"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if info, err := os.Stat(dirPath); err != nil || !info.IsDir() {
+				writeError(w, http.StatusBadRequest, "invalid directory")
+				return
+			}
+			name, err := cleanUploadPath(metadata["filename"])
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "missing or invalid filename metadata")
+				return
+			}
+			targetPath, err := resolvePath(baseDir, path.Join(toRelative(baseDir, dirPath), name))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			conflict := r.URL.Query().Get("conflict")
+			if conflict == "" {
+				conflict = conflictRename
+			}
+			if !validConflictPolicy(conflict) {
+				writeError(w, http.StatusBadRequest, "invalid conflict policy")
+				return
+			}
+			target := toRelative(baseDir, targetPath)
+			if !allowPath(w, r, target, ActionWrite) {
+				return
+			}
+			// Refuse early what would fail once all the data is in.
+			if info, err := os.Stat(targetPath); err == nil {
+				if conflict == conflictFail {
+					writeError(w, http.StatusConflict, "file already exists")
+					return
+				}
+				if info.IsDir() && conflict == conflictOverwrite {
+					writeError(w, http.StatusConflict, "a directory with this name exists")
+					return
+				}
+			}
+			upload, err := tm.Create(target, user.Username, conflict, length, r.Header.Get("Upload-Metadata"))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if length == 0 && !finish(upload) {
+				return
+			}
+			w.Header().Set("Location", tusBasePath+upload.ID)
+			tm.setExpires(w, upload.CreatedAt)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		upload, offset, err := tm.Get(id)
+		if err == nil && upload.Owner != user.Username {
+			err = errTusUploadNotFound
+		}
+		if errors.Is(err, errTusUploadNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		switch r.Method {
+		case http.MethodHead:
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+			if upload.Metadata != "" {
+				w.Header().Set("Upload-Metadata", upload.Metadata)
+			}
+			w.WriteHeader(http.StatusOK)
+		case http.MethodPatch:
+			if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+				writeError(w, http.StatusUnsupportedMediaType, "content type must be application/offset+octet-stream")
+				return
+			}
+			if !tm.lock(id) {
+				writeError(w, http.StatusConflict, "upload is being written by another request")
+				return
+			}
+			defer tm.unlock(id)
+			// Re-read the offset now that no other request can change it.
+			if _, offset, err = tm.Get(id); err != nil {
+				writeError(w, http.StatusNotFound, errTusUploadNotFound.Error())
+				return
+			}
+			clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+			if err != nil || clientOffset != offset {
+				writeError(w, http.StatusConflict, "Upload-Offset does not match")
+				return
+			}
+			offset, err = tm.Append(upload, offset, r.Body)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if offset == upload.Length {
+				if !finish(upload) {
+					return
+				}
+			} else {
+				tm.setExpires(w, time.Now())
+			}
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			if !tm.lock(id) {
+				writeError(w, http.StatusConflict, "upload is being written by another request")
+				return
+			}
+			defer tm.unlock(id)
+			if err := tm.Terminate(id); err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
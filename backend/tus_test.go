@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tusRequest sends a tus request to server as the holder of token, with
+// Tus-Resumable set unless header overrides it.
+func tusRequest(server http.Handler, method, target, token string, header map[string]string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for key, value := range header {
+		r.Header.Set(key, value)
+	}
+	if token != "" {
+		r.Header.Set("X-Session-Token", token)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	return w
+}
+
+func tusFilename(name string) string {
+	return "filename " + base64.StdEncoding.EncodeToString([]byte(name))
+}
+
+// createTusUpload starts an upload of length bytes as name in dir and
+// returns its URL.
+func createTusUpload(t *testing.T, server http.Handler, token, dir, name, conflict string, length string) string {
+	t.Helper()
+	w := tusRequest(server, http.MethodPost, "/api/tus?path="+dir+"&conflict="+conflict, token, map[string]string{
+		"Upload-Length":   length,
+		"Upload-Metadata": tusFilename(name),
+	}, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create = %d, want %d: %s", w.Code, http.StatusCreated, w.Body.String())
+	}
+	return w.Header().Get("Location")
+}
+
+func TestTusCreate(t *testing.T) {
+	tokens := newTestUsers(t, map[string]Role{"editor": RoleEditor})
+	tests := []struct {
+		name     string
+		header   map[string]string
+		want     int
+		wantFile string // file that must exist afterwards, for empty uploads
+	}{
+		{"valid", map[string]string{"Upload-Length": "5", "Upload-Metadata": tusFilename("a.txt")}, http.StatusCreated, ""},
+		{"metadata with several keys", map[string]string{"Upload-Length": "5", "Upload-Metadata": "filetype dGV4dC9wbGFpbg==, " + tusFilename("dir/a.txt")}, http.StatusCreated, ""},
+		{"empty upload is stored at once", map[string]string{"Upload-Length": "0", "Upload-Metadata": tusFilename("empty.txt")}, http.StatusCreated, "empty.txt"},
+		{"missing length", map[string]string{"Upload-Metadata": tusFilename("a.txt")}, http.StatusBadRequest, ""},
+		{"negative length", map[string]string{"Upload-Length": "-1", "Upload-Metadata": tusFilename("a.txt")}, http.StatusBadRequest, ""},
+		{"over the size limit", map[string]string{"Upload-Length": "11", "Upload-Metadata": tusFilename("a.txt")}, http.StatusRequestEntityTooLarge, ""},
+		{"invalid metadata encoding", map[string]string{"Upload-Length": "5", "Upload-Metadata": "filename not-base64!"}, http.StatusBadRequest, ""},
+		{"missing filename", map[string]string{"Upload-Length": "5"}, http.StatusBadRequest, ""},
+		{"filename leaving the directory", map[string]string{"Upload-Length": "5", "Upload-Metadata": tusFilename("../a.txt")}, http.StatusBadRequest, ""},
+		{"unsupported version", map[string]string{"Tus-Resumable": "0.2.0", "Upload-Length": "5", "Upload-Metadata": tusFilename("a.txt")}, http.StatusPreconditionFailed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := newTestDataDir(t)
+			if err := InitTusManager(dataDir, time.Hour, 10); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(GetTusManager().Close)
+			server := newTestServer(t, dataDir)
+
+			w := tusRequest(server, http.MethodPost, "/api/tus?path=", tokens["editor"], tt.header, "")
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if tt.want == http.StatusCreated && !strings.HasPrefix(w.Header().Get("Location"), tusBasePath) {
+				t.Errorf("Location = %q, want it below %s", w.Header().Get("Location"), tusBasePath)
+			}
+			if tt.wantFile != "" {
+				if _, err := os.Stat(filepath.Join(dataDir, tt.wantFile)); err != nil {
+					t.Errorf("%s not stored: %v", tt.wantFile, err)
+				}
+			}
+		})
+	}
+}
+
+func TestTusPatch(t *testing.T) {
+	tokens := newTestUsers(t, map[string]Role{"alice": RoleEditor, "bob": RoleEditor})
+	const octets = "application/offset+octet-stream"
+	dataDir := newTestDataDir(t)
+	server := newTestServer(t, dataDir)
+	location := createTusUpload(t, server, tokens["alice"], "", "a.txt", conflictRename, "10")
+
+	steps := []struct {
+		name       string
+		method     string
+		token      string
+		header     map[string]string
+		body       string
+		want       int
+		wantOffset string
+	}{
+		{"first chunk", http.MethodPatch, tokens["alice"], map[string]string{"Content-Type": octets, "Upload-Offset": "0"}, "hello", http.StatusNoContent, "5"},
+		{"resume offset", http.MethodHead, tokens["alice"], nil, "", http.StatusOK, "5"},
+		{"hidden from other users", http.MethodHead, tokens["bob"], nil, "", http.StatusNotFound, ""},
+		{"wrong offset", http.MethodPatch, tokens["alice"], map[string]string{"Content-Type": octets, "Upload-Offset": "0"}, "world", http.StatusConflict, ""},
+		{"wrong content type", http.MethodPatch, tokens["alice"], map[string]string{"Content-Type": "text/plain", "Upload-Offset": "5"}, "world", http.StatusUnsupportedMediaType, ""},
+		{"offset unchanged by refused chunks", http.MethodHead, tokens["alice"], nil, "", http.StatusOK, "5"},
+		{"last chunk", http.MethodPatch, tokens["alice"], map[string]string{"Content-Type": octets, "Upload-Offset": "5"}, "world", http.StatusNoContent, "10"},
+		{"gone once finished", http.MethodHead, tokens["alice"], nil, "", http.StatusNotFound, ""},
+	}
+	for _, step := range steps {
+		w := tusRequest(server, step.method, location, step.token, step.header, step.body)
+		if w.Code != step.want {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.want, w.Body.String())
+		}
+		if got := w.Header().Get("Upload-Offset"); step.wantOffset != "" && got != step.wantOffset {
+			t.Errorf("%s: Upload-Offset = %q, want %q", step.name, got, step.wantOffset)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dataDir, "a.txt"))
+	if err != nil || string(data) != "helloworld" {
+		t.Errorf("a.txt = %q, %v; want %q", data, err, "helloworld")
+	}
+}
+
+// TestTusFinishChecks covers the checks repeated when the last byte
+// arrives, as the data dir and the rules may have changed meanwhile.
+func TestTusFinishChecks(t *testing.T) {
+	tokens := newTestUsers(t, map[string]Role{"bob": RoleEditor})
+	tests := []struct {
+		name      string
+		conflict  string
+		change    func(t *testing.T, dataDir string)
+		want      int
+		wantBody  string
+		wantTrash int
+	}{
+		{"name taken meanwhile", conflictFail, func(t *testing.T, dataDir string) {
+			writeTestFile(t, dataDir, "docs/a.txt", "old")
+		}, http.StatusConflict, "old", 0},
+		{"overwrite keeps the old file in the trash", conflictOverwrite, func(t *testing.T, dataDir string) {
+			writeTestFile(t, dataDir, "docs/a.txt", "old")
+		}, http.StatusNoContent, "new", 1},
+		{"directory closed meanwhile", conflictRename, func(t *testing.T, dataDir string) {
+			if err := GetPermissionManager().AddPermission(mustEntries(t, "/docs user:alice rwd")[0]); err != nil {
+				t.Fatal(err)
+			}
+		}, http.StatusForbidden, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := newTestDataDir(t)
+			writeTestFile(t, dataDir, "docs/.keep", "")
+			server := newTestServer(t, dataDir)
+			location := createTusUpload(t, server, tokens["bob"], "docs", "a.txt", tt.conflict, "3")
+			tt.change(t, dataDir)
+
+			w := tusRequest(server, http.MethodPatch, location, tokens["bob"], map[string]string{
+				"Content-Type":  "application/offset+octet-stream",
+				"Upload-Offset": "0",
+			}, "new")
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			data, _ := os.ReadFile(filepath.Join(dataDir, "docs", "a.txt"))
+			if string(data) != tt.wantBody {
+				t.Errorf("docs/a.txt = %q, want %q", data, tt.wantBody)
+			}
+			items, err := GetTrashManager().List()
+			if err != nil || len(items) != tt.wantTrash {
+				t.Errorf("trash has %d item(s), %v; want %d", len(items), err, tt.wantTrash)
+			}
+		})
+	}
+}
+
+func TestTusExpire(t *testing.T) {
+	newTestDataDir(t)
+	tm := GetTusManager()
+	old, err := tm.Create("old.txt", "editor", conflictRename, 5, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(tm.dataPath(old.ID), stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := tm.Create("fresh.txt", "editor", conflictRename, 5, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := tm.ExpireOlderThan(time.Now().Add(-time.Hour))
+	if err != nil || expired != 1 {
+		t.Fatalf("ExpireOlderThan() = %d, %v; want 1", expired, err)
+	}
+	if _, _, err := tm.Get(old.ID); !errors.Is(err, errTusUploadNotFound) {
+		t.Errorf("expired upload still there: %v", err)
+	}
+	if _, err := os.Stat(tm.infoPath(old.ID)); !os.IsNotExist(err) {
+		t.Errorf("info file of the expired upload left behind: %v", err)
+	}
+	if _, _, err := tm.Get(fresh.ID); err != nil {
+		t.Errorf("fresh upload expired: %v", err)
+	}
+}
+
+func TestTusFinish(t *testing.T) {
+	tests := []struct {
+		name       string
+		commitErr  error
+		wantBody   string
+		wantStaged bool
+	}{
+		{name: "replaces the target after commit", wantBody: "new"},
+		{name: "failed commit keeps target and upload", commitErr: errors.New("trash full"), wantBody: "old", wantStaged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := newTestDataDir(t)
+			writeTestFile(t, dataDir, "a.txt", "old")
+			tm := GetTusManager()
+			upload, err := tm.Create("a.txt", "editor", conflictOverwrite, 3, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tm.Append(upload, 0, strings.NewReader("new")); err != nil {
+				t.Fatal(err)
+			}
+
+			target := filepath.Join(dataDir, "a.txt")
+			err = tm.Finish(upload, target, func() error {
+				if tt.commitErr != nil {
+					return tt.commitErr
+				}
+				_, err := GetTrashManager().Move("a.txt", "editor")
+				return err
+			})
+			if !errors.Is(err, tt.commitErr) {
+				t.Fatalf("Finish() error = %v, want %v", err, tt.commitErr)
+			}
+			data, err := os.ReadFile(target)
+			if err != nil || string(data) != tt.wantBody {
+				t.Errorf("a.txt = %q, %v; want %q", data, err, tt.wantBody)
+			}
+			_, offset, err := tm.Get(upload.ID)
+			if staged := err == nil && offset == 3; staged != tt.wantStaged {
+				t.Errorf("upload still staged = %v (%v), want %v", staged, err, tt.wantStaged)
+			}
+		})
+	}
+}
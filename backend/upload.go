@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultUploadMaxSize limits the body of one /api/upload request; larger
+// files should go through the resumable upload endpoint.
+const defaultUploadMaxSize = 1 << 30
+
+// UploadResult reports the outcome for one file of an upload request.
+// Status is "uploaded", "conflict" (the name was taken and the conflict
+// policy is "fail") or "failed"; Path is where the file was stored.
+type UploadResult struct {
+	Name   string `json:"name"`
+	Path   string `json:"path,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// code is the HTTP status matching a failure, which the response
+	// uses when no file of the request could be stored.
+	code int
+}
+
+// uploadFileName returns the filename a client sent for a multipart part,
+// including any directories. mime/multipart strips those, but folder uploads
+// send the file's webkitRelativePath there to recreate the folder layout.
+func uploadFileName(header textproto.MIMEHeader) string {
+	_, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+// cleanUploadPath turns a client supplied relative file path into a clean
+// slash-separated path, rejecting anything that tries to climb out of the
+// upload directory.
+func cleanUploadPath(name string) (string, error) {
+	var segments []string
+	for _, segment := range strings.Split(strings.ReplaceAll(name, "\\", "/"), "/") {
+		switch segment {
+		case "":
+			continue
+		case ".", "..":
+			return "", errors.New("invalid filename")
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		return "", errors.New("invalid filename")
+	}
+	return path.Join(segments...), nil
+}
+
+// parseByteSize parses a size such as "512M", "2G" or "1048576". Suffixes
+// K, M, G and T (optionally followed by "B" or "iB") are powers of 1024.
+func parseByteSize(value string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	number = strings.TrimSuffix(strings.TrimSuffix(number, "B"), "I")
+	multiplier := int64(1)
+	if n := len(number); n > 0 {
+		if i := strings.IndexByte("KMGT", number[n-1]); i >= 0 {
+			multiplier = int64(1) << (10 * (i + 1))
+			number = number[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || size < 0 || size > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * multiplier, nil
+}
+
+// storeUpload writes one uploaded file, sent as name, below the data-dir
+// relative directory dirRel, handling an existing file according to the
+// conflict policy; an overwritten file goes to the trash. The file is
+// streamed to a temporary file and only renamed into place once complete,
+// so a failed or aborted upload leaves nothing behind and keeps the file
+// it would have replaced.
+func storeUpload(baseDir, dirRel string, user *User, name, conflict string, src io.Reader) UploadResult {
+	result := UploadResult{Name: name, Status: "failed"}
+	fail := func(code int, message string) UploadResult {
+		result.code, result.Error = code, message
+		return result
+	}
+	rel, err := cleanUploadPath(name)
+	if err != nil {
+		return fail(http.StatusBadRequest, err.Error())
+	}
+	destPath, err := resolvePath(baseDir, path.Join(dirRel, rel))
+	if err != nil {
+		return fail(http.StatusBadRequest, err.Error())
+	}
+	if info, err := os.Stat(destPath); err == nil && info.IsDir() && conflict == conflictOverwrite {
+		return fail(http.StatusConflict, "a directory with this name exists")
+	}
+	targetPath, replace, err := resolveConflict(destPath, conflict)
+	if errors.Is(err, errTargetExists) {
+		result.Status = "conflict"
+		return fail(http.StatusConflict, "file already exists")
+	} else if err != nil {
+		return fail(http.StatusInternalServerError, err.Error())
+	}
+	targetRel := toRelative(baseDir, targetPath)
+	pm := GetPermissionManager()
+	if !pm.Check(user, targetRel, ActionWrite) || (replace && !pm.Check(user, targetRel, ActionDelete)) {
+		return fail(http.StatusForbidden, "no permission")
+	}
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
+		return fail(http.StatusInternalServerError, err.Error())
+	}
+	// The old file only goes to the trash once the upload is complete.
+	err = writeAtomicCommit(targetPath, 0o644, func(out io.Writer) error {
+		_, err := io.Copy(out, src)
+		return err
+	}, func() error {
+		if !replace {
+			return nil
+		}
+		_, err := GetTrashManager().Move(targetRel, user.Username)
+		return err
+	})
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("upload exceeds the limit of %d bytes", tooLarge.Limit))
+	} else if err != nil {
+		return fail(http.StatusInternalServerError, err.Error())
+	}
+	GetSearchManager().Refresh(targetRel)
+	result.Path = targetRel
+	result.Status = "uploaded"
+	return result
+}
+
+// uploadFailureStatus picks the status for a request in which no file was
+// stored: the one all failures share, or else 500 if any was a server
+// error and 400 otherwise.
+func uploadFailureStatus(results []UploadResult) int {
+	status := results[0].code
+	for _, result := range results[1:] {
+		if result.code != status {
+			status = http.StatusBadRequest
+			break
+		}
+	}
+	for _, result := range results {
+		if result.code >= 500 {
+			return http.StatusInternalServerError
+		}
+	}
+	return status
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestStoreUploadOverwrite(t *testing.T) {
+	editor := &User{Username: "editor", Role: RoleEditor}
+	tests := []struct {
+		name       string
+		src        io.Reader
+		wantStatus string
+		wantBody   string
+		wantTrash  int
+	}{
+		{
+			name:       "complete upload replaces the file",
+			src:        strings.NewReader("new"),
+			wantStatus: "uploaded",
+			wantBody:   "new",
+			wantTrash:  1,
+		},
+		{
+			name:       "failed upload keeps the file",
+			src:        io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("connection reset"))),
+			wantStatus: "failed",
+			wantBody:   "old",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := newTestDataDir(t)
+			writeTestFile(t, dataDir, "a.txt", "old")
+
+			result := storeUpload(dataDir, "", editor, "a.txt", conflictOverwrite, tt.src)
+			if result.Status != tt.wantStatus {
+				t.Fatalf("status = %q (%s), want %q", result.Status, result.Error, tt.wantStatus)
+			}
+			data, err := os.ReadFile(filepath.Join(dataDir, "a.txt"))
+			if err != nil {
+				t.Fatalf("a.txt: %v", err)
+			}
+			if string(data) != tt.wantBody {
+				t.Errorf("a.txt = %q, want %q", data, tt.wantBody)
+			}
+			items, err := GetTrashManager().List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != tt.wantTrash {
+				t.Errorf("trash has %d item(s), want %d", len(items), tt.wantTrash)
+			}
+			entries, err := os.ReadDir(dataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if strings.Contains(entry.Name(), ".tmp-") {
+					t.Errorf("temporary file %s left behind", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+// uploadFile is one part of a multipart upload request.
+type uploadFile struct {
+	name    string
+	content string
+}
+
+func uploadRequest(t *testing.T, target string, files ...uploadFile) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, file := range files {
+		part, err := form.CreateFormFile("file", file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(file.content))
+	}
+	form.Close()
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+func TestUploadStatus(t *testing.T) {
+	tokens := newTestUsers(t, map[string]Role{"editor": RoleEditor})
+	large := strings.Repeat("x", 1<<20+1)
+	tests := []struct {
+		name       string
+		conflict   string
+		files      []uploadFile
+		wantCode   int
+		wantStatus string
+		wantFiles  []string
+		wantStored []string
+	}{
+		{
+			name:       "all files stored",
+			files:      []uploadFile{{"a.txt", "a"}, {"b.txt", "b"}},
+			wantCode:   http.StatusOK,
+			wantStatus: "uploaded",
+			wantFiles:  []string{"uploaded", "uploaded"},
+			wantStored: []string{"a.txt", "b.txt"},
+		},
+		{
+			name:       "some files fail",
+			files:      []uploadFile{{"a.txt", "a"}, {"locked/b.txt", "b"}, {"../c.txt", "c"}},
+			wantCode:   http.StatusOK,
+			wantStatus: "partial",
+			wantFiles:  []string{"uploaded", "failed", "failed"},
+			wantStored: []string{"a.txt"},
+		},
+		{
+			name:      "all files forbidden",
+			files:     []uploadFile{{"locked/a.txt", "a"}, {"locked/b.txt", "b"}},
+			wantCode:  http.StatusForbidden,
+			wantFiles: []string{"failed", "failed"},
+		},
+		{
+			name:      "all files fail for different reasons",
+			files:     []uploadFile{{"locked/a.txt", "a"}, {"../b.txt", "b"}},
+			wantCode:  http.StatusBadRequest,
+			wantFiles: []string{"failed", "failed"},
+		},
+		{
+			name:      "all files exist",
+			conflict:  conflictFail,
+			files:     []uploadFile{{"old.txt", "new"}},
+			wantCode:  http.StatusConflict,
+			wantFiles: []string{"conflict"},
+		},
+		{
+			name:       "size limit",
+			files:      []uploadFile{{"a.txt", "a"}, {"big.txt", large}, {"c.txt", "c"}},
+			wantCode:   http.StatusRequestEntityTooLarge,
+			wantFiles:  []string{"uploaded", "failed"},
+			wantStored: []string{"a.txt"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := newTestDataDir(t, "/locked user:admin rwd")
+			writeTestFile(t, dataDir, "old.txt", "old")
+			if err := os.Mkdir(filepath.Join(dataDir, "locked"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			server := newTestServer(t, dataDir)
+
+			target := "/api/upload?path="
+			if tt.conflict != "" {
+				target += "&conflict=" + tt.conflict
+			}
+			r := uploadRequest(t, target, tt.files...)
+			r.Header.Set("X-Session-Token", tokens["editor"])
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			var resp struct {
+				Status string         `json:"status"`
+				Error  string         `json:"error"`
+				Files  []UploadResult `json:"files"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", resp.Status, tt.wantStatus)
+			}
+			if tt.wantCode != http.StatusOK && resp.Error == "" {
+				t.Error("error response without a message")
+			}
+			var got []string
+			for _, file := range resp.Files {
+				got = append(got, file.Status)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.wantFiles, ",") {
+				t.Errorf("file statuses = %v, want %v", got, tt.wantFiles)
+			}
+
+			stored := []string{}
+			err := filepath.WalkDir(dataDir, func(filePath string, entry os.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if entry.Name() == systemDirName {
+					return filepath.SkipDir
+				}
+				if entry.IsDir() {
+					return nil
+				}
+				rel, _ := filepath.Rel(dataDir, filePath)
+				if rel != "old.txt" {
+					stored = append(stored, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(stored, ",") != strings.Join(tt.wantStored, ",") {
+				t.Errorf("data dir holds %v, want %v", stored, tt.wantStored)
+			}
+		})
+	}
+}